@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bgmerrell/tftpdmem"
+	"github.com/bgmerrell/tftpdmem/defs"
+	fmgr "github.com/bgmerrell/tftpdmem/filemanager"
+	"github.com/bgmerrell/tftpdmem/server"
+)
+
+// flags
+var (
+	port          int
+	maxBlockSize  int
+	maxWindowSize int
+	rollover      int
+	capacity      int
+	timeout       time.Duration
+	retries       int
+	backoff       bool
+	overwrite     string
+	writeConflict string
+	singlePort    bool
+	portRange     string
+	gracePeriod   time.Duration
+	rootDir       string
+	snapshotFile  string
+	snapshotEvery time.Duration
+	journalFile   string
+	compactSize   int64
+	// overwritePrefixes maps filename prefixes to overwrite policies
+	overwritePrefixes = make(prefixPolicies)
+	listenAddrs       stringList
+	preloads          stringList
+	preloadReadOnly   bool
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (a *stringList) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *stringList) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// prefixPolicies is a repeatable flag of prefix=policy pairs
+type prefixPolicies map[string]fmgr.OverwritePolicy
+
+func (p prefixPolicies) String() string {
+	var pairs []string
+	for prefix, policy := range p {
+		pairs = append(pairs, prefix+"="+policy.String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p prefixPolicies) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return errors.New("Expected prefix=policy")
+	}
+	policy, err := fmgr.ParseOverwritePolicy(value[i+1:])
+	if err != nil {
+		return err
+	}
+	p[value[:i]] = policy
+	return nil
+}
+
+func init() {
+	flag.IntVar(&port, "port", 69, "Port for the tftp server")
+	flag.Var(&listenAddrs, "listen",
+		"Address to listen on, as host:port (may be repeated; "+
+			"default :port, which is dual-stack)")
+	flag.IntVar(&maxBlockSize, "max-blksize", defs.MaxBlockSize,
+		"Largest block size that clients can negotiate")
+	flag.IntVar(&maxWindowSize, "max-windowsize", 64,
+		"Largest window size that clients can negotiate")
+	flag.IntVar(&rollover, "rollover", 0,
+		"Block number (0 or 1) that follows block 65535")
+	flag.IntVar(&capacity, "capacity", 0,
+		"Most bytes of file data to store (0 means no limit)")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second,
+		"Default time to wait for a client during a transfer")
+	flag.IntVar(&retries, "retries", 5,
+		"Retransmissions before a transfer is abandoned")
+	flag.BoolVar(&backoff, "backoff", false,
+		"Double the timeout after each retransmission")
+	flag.StringVar(&overwrite, "overwrite", "reject",
+		"What to do when a client writes an existing file "+
+			"(reject, overwrite, or keep-versioned)")
+	flag.Var(overwritePrefixes, "overwrite-prefix",
+		"Overwrite policy for filenames with a prefix, as prefix=policy "+
+			"(may be repeated)")
+	flag.BoolVar(&singlePort, "single-port", false,
+		"Run transfers over the main port instead of a new port each")
+	flag.StringVar(&portRange, "port-range", "",
+		"Ports for transfers, as min-max (default any port)")
+	flag.DurationVar(&gracePeriod, "grace-period", 30*time.Second,
+		"How long to let transfers finish on shutdown before aborting them")
+	flag.StringVar(&writeConflict, "write-conflict", "reject",
+		"What to do when a client writes a file that another client is "+
+			"writing (reject or queue)")
+	flag.StringVar(&rootDir, "root", "",
+		"Directory to serve files from and write uploads to (default keep "+
+			"files in memory)")
+	flag.StringVar(&snapshotFile, "snapshot", "",
+		"File to save the in-memory files to on shutdown and to load them "+
+			"from on startup (default none)")
+	flag.DurationVar(&snapshotEvery, "snapshot-interval", 5*time.Minute,
+		"How often to save the snapshot while running (0 means only on "+
+			"shutdown)")
+	flag.Var(&preloads, "preload",
+		"Directory, .tar, .tar.gz, or .zip of files to load on startup "+
+			"(may be repeated)")
+	flag.BoolVar(&preloadReadOnly, "preload-readonly", false,
+		"Stop clients from replacing preloaded files")
+	flag.StringVar(&journalFile, "journal", "",
+		"File to journal the in-memory files to as they're written, and to "+
+			"replay them from on startup (default none)")
+	flag.Int64Var(&compactSize, "journal-compact", 64<<20,
+		"Journal size in bytes past which it's compacted (0 means never)")
+	flag.Parse()
+}
+
+// parsePortRange parses a port range like "50000-50100" into cfg, which
+// validates it.  An empty range leaves cfg's range as it is.
+func parsePortRange(cfg *server.Config, portRange string) error {
+	if portRange == "" {
+		return nil
+	}
+	_, err := fmt.Sscanf(portRange, "%d-%d", &cfg.MinPort, &cfg.MaxPort)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid port range: %s", portRange))
+	}
+	return cfg.Validate()
+}
+
+func main() {
+	if maxBlockSize < defs.MinBlockSize || maxBlockSize > defs.MaxBlockSize {
+		log.Printf("max-blksize must be between %d and %d",
+			defs.MinBlockSize, defs.MaxBlockSize)
+		os.Exit(1)
+	}
+	if maxWindowSize < defs.MinWindowSize || maxWindowSize > defs.MaxWindowSize {
+		log.Printf("max-windowsize must be between %d and %d",
+			defs.MinWindowSize, defs.MaxWindowSize)
+		os.Exit(1)
+	}
+	if rollover != 0 && rollover != 1 {
+		log.Println("rollover must be 0 or 1")
+		os.Exit(1)
+	}
+	if timeout <= 0 {
+		log.Println("timeout must be positive")
+		os.Exit(1)
+	}
+	if retries < 0 {
+		log.Println("retries must not be negative")
+		os.Exit(1)
+	}
+	if gracePeriod < 0 {
+		log.Println("grace-period must not be negative")
+		os.Exit(1)
+	}
+	if snapshotEvery < 0 {
+		log.Println("snapshot-interval must not be negative")
+		os.Exit(1)
+	}
+	if snapshotFile != "" && rootDir != "" {
+		log.Println("snapshot is for in-memory files and can't be used with root")
+		os.Exit(1)
+	}
+	if journalFile != "" && (rootDir != "" || snapshotFile != "") {
+		log.Println("journal can't be used with root or snapshot")
+		os.Exit(1)
+	}
+	if compactSize < 0 {
+		log.Println("journal-compact must not be negative")
+		os.Exit(1)
+	}
+	policy, err := fmgr.ParseOverwritePolicy(overwrite)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	conflictPolicy, err := fmgr.ParseWriteConflictPolicy(writeConflict)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	cfg := server.DefaultConfig()
+	cfg.MaxBlockSize = maxBlockSize
+	cfg.MaxWindowSize = maxWindowSize
+	cfg.Rollover = rollover
+	cfg.Timeout = timeout
+	cfg.Retries = retries
+	cfg.Backoff = backoff
+	cfg.SinglePort = singlePort
+	if err := parsePortRange(cfg, portRange); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringList{fmt.Sprintf(":%d", port)}
+	}
+	var conns []*net.UDPConn
+	for _, addr := range listenAddrs {
+		laddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Println("Failed to resolve UDP addr:", err)
+			os.Exit(1)
+		}
+		conn, err := net.ListenUDP(laddr.Network(), laddr)
+		if err != nil {
+			log.Println("ListenUDP failure:", err)
+			os.Exit(1)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	var store fmgr.Store
+	if rootDir != "" {
+		dirStore, err := fmgr.NewDirStore(rootDir)
+		if err != nil {
+			log.Println("Failed to open root directory:", err)
+			os.Exit(1)
+		}
+		defer dirStore.Close()
+		store = dirStore
+	}
+	if journalFile != "" {
+		journal, err := fmgr.NewJournalStore(journalFile, fmgr.NewMemStore(),
+			compactSize)
+		if err != nil {
+			log.Println("Failed to replay journal:", err)
+			os.Exit(1)
+		}
+		defer journal.Close()
+		store = journal
+	}
+	s, err := tftpdmem.New(tftpdmem.Options{
+		Config:          cfg,
+		Capacity:        capacity,
+		Overwrite:       policy,
+		PrefixOverwrite: overwritePrefixes,
+		WriteConflict:   conflictPolicy,
+		Store:           store})
+	if err != nil {
+		log.Println("Failed to load files:", err)
+		os.Exit(1)
+	}
+	if snapshotFile != "" {
+		err := s.Files().LoadSnapshot(snapshotFile)
+		if err == nil {
+			log.Printf("Loaded %d file(s) from snapshot %s",
+				len(s.Files().Filenames()), snapshotFile)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to load snapshot:", err)
+			os.Exit(1)
+		}
+		if snapshotEvery > 0 {
+			go func() {
+				for range time.Tick(snapshotEvery) {
+					saveSnapshot(s)
+				}
+			}()
+		}
+	}
+	// Preloaded files replace snapshotted ones of the same names
+	for _, preload := range preloads {
+		n, err := s.Files().Preload(preload, preloadReadOnly)
+		if err != nil {
+			log.Println("Failed to preload files:", err)
+			os.Exit(1)
+		}
+		log.Printf("Preloaded %d file(s) from %s", n, preload)
+	}
+	for _, conn := range conns {
+		log.Println("Starting tftpdmem on", conn.LocalAddr())
+		go func(conn *net.UDPConn) {
+			err := s.Serve(conn)
+			if err != tftpdmem.ErrServerClosed {
+				log.Println("Server stopped:", err)
+			}
+		}(conn)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	log.Println(<-sigCh)
+	shutdown(s, sigCh)
+}
+
+// shutdown drains the server, giving its transfers up to the grace period to
+// finish, and logs the transfers that had to be aborted.  Another signal exits
+// right away.
+func shutdown(s *tftpdmem.Server, sigCh chan os.Signal) {
+	log.Printf("Shutting down, waiting up to %s for transfers to finish",
+		gracePeriod)
+	go func() {
+		log.Println(<-sigCh, "again, exiting now")
+		os.Exit(1)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	interrupted, _ := s.Shutdown(ctx)
+	if len(interrupted) == 0 {
+		log.Println("All transfers finished")
+	} else {
+		log.Printf("Aborted %d transfer(s):", len(interrupted))
+		for _, desc := range interrupted {
+			log.Println("  " + desc)
+		}
+	}
+	if snapshotFile != "" && saveSnapshot(s) {
+		log.Println("Saved snapshot to", snapshotFile)
+	}
+}
+
+// snapshotMu keeps a timed snapshot from finishing after (and so replacing)
+// the one saved on shutdown
+var snapshotMu sync.Mutex
+
+// saveSnapshot saves a snapshot of the server's files, logging any failure,
+// and returns whether it succeeded
+func saveSnapshot(s *tftpdmem.Server) bool {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if err := s.Files().SaveSnapshot(snapshotFile); err != nil {
+		log.Println("Failed to save snapshot:", err)
+		return false
+	}
+	return true
+}
@@ -3,13 +3,19 @@ package defs
 
 // misc
 const (
-	BlockSize      = 512
+	BlockSize      = 512 // the default block size
+	MinBlockSize   = 8   // blksize bounds (RFC 2348)
+	MaxBlockSize   = 65464
+	MinTimeout     = 1 // timeout bounds in seconds (RFC 2349)
+	MaxTimeout     = 255
+	MinWindowSize  = 1 // windowsize bounds (RFC 7440)
+	MaxWindowSize  = 65535
 	OpCodeSize     = 2
 	BlockNumSize   = 2
 	DataHeaderSize = OpCodeSize + BlockNumSize
 	DatagramSize   = BlockSize + DataHeaderSize
 	MinOpCode      = 1
-	MaxOpCode      = 5
+	MaxOpCode      = 6
 	FirstDataBlock = 1
 )
 
@@ -20,6 +26,7 @@ const (
 	OpData
 	OpAck
 	OpErr
+	OpOack
 )
 
 // err codes
@@ -32,4 +39,5 @@ const (
 	ErrUnknownTid
 	ErrFileExists
 	ErrNoSuchUser
+	ErrOptionNegotiation
 )
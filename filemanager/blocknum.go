@@ -0,0 +1,39 @@
+package filemanager
+
+// Block numbers on the wire are only 16 bits, so a transfer of more than 65535
+// blocks rolls the block number over to 0 or 1 (clients disagree on which).
+// Transfers count blocks with a 64-bit logical block number instead and map
+// wire block numbers onto it.
+
+// wireBlockNum returns the wire block number of logical block n when the
+// block number rolls over to rollover (0 or 1).
+func wireBlockNum(n uint64, rollover int) uint16 {
+	if rollover == 0 || n == 0 {
+		return uint16(n)
+	}
+	return uint16((n-1)%0xffff + 1)
+}
+
+// logicalBlockNum returns the logical block number for the wire block number
+// that is closest to logical block near.  ok is false if there is no such
+// block (i.e., it would come before block 0).
+func logicalBlockNum(wire uint16, near uint64, rollover int) (n uint64, ok bool) {
+	period := int64(0x10000)
+	if rollover != 0 {
+		// Block 0 is only ever the ACK of a WRQ or OACK
+		if wire == 0 {
+			return 0, true
+		}
+		period = 0xffff
+	}
+	diff := (int64(wire) - int64(wireBlockNum(near, rollover))) % period
+	if diff >= period/2 {
+		diff -= period
+	} else if diff < -period/2 {
+		diff += period
+	}
+	if diff < 0 && uint64(-diff) > near {
+		return 0, false
+	}
+	return uint64(int64(near) + diff), true
+}
@@ -0,0 +1,59 @@
+package filemanager
+
+import (
+	"testing"
+)
+
+func TestWireBlockNum(t *testing.T) {
+	tests := []struct {
+		n        uint64
+		rollover int
+		expected uint16
+	}{
+		{0, 0, 0},
+		{65535, 0, 65535},
+		{65536, 0, 0},
+		{65537, 0, 1},
+		{0, 1, 0},
+		{65535, 1, 65535},
+		{65536, 1, 1},
+		{131070, 1, 65535},
+		{131071, 1, 1},
+	}
+	for _, test := range tests {
+		wire := wireBlockNum(test.n, test.rollover)
+		if wire != test.expected {
+			t.Errorf("wireBlockNum(%d, %d): %d, want: %d",
+				test.n, test.rollover, wire, test.expected)
+		}
+	}
+}
+
+func TestLogicalBlockNum(t *testing.T) {
+	tests := []struct {
+		wire     uint16
+		near     uint64
+		rollover int
+		expected uint64
+		ok       bool
+	}{
+		{0, 0, 0, 0, true},
+		{1, 0, 0, 1, true},
+		{65535, 0, 0, 0, false},
+		{0, 65535, 0, 65536, true},
+		{65535, 65536, 0, 65535, true},
+		{5, 200000, 0, 196613, true},
+		{0, 0, 1, 0, true},
+		{1, 65535, 1, 65536, true},
+		{65535, 65536, 1, 65535, true},
+		{1, 131070, 1, 131071, true},
+	}
+	for _, test := range tests {
+		n, ok := logicalBlockNum(test.wire, test.near, test.rollover)
+		if n != test.expected || ok != test.ok {
+			t.Errorf("logicalBlockNum(%d, %d, %d): %d (%t), want: %d (%t)",
+				test.wire, test.near, test.rollover, n, ok,
+				test.expected, test.ok)
+		}
+	}
+}
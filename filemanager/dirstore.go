@@ -0,0 +1,265 @@
+package filemanager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// stagingPrefix starts the names of the temp files that DirStore uploads are
+// staged in, which List leaves out.
+const stagingPrefix = ".tftpdmem-"
+
+// A DirStore is a Store that serves the files under a root directory.  Names
+// are slash-separated paths relative to the root (a leading slash is
+// ignored), and neither ".." nor symlinks can reach outside of it.  Uploads
+// are staged in temp files next to their targets and renamed into place when
+// they're committed.  Directories created for an upload are removed again if
+// it's aborted.
+type DirStore struct {
+	root *os.Root
+	// dirMu is held while directories are created for an upload and its
+	// temp file is created in them, and while they're removed again, so
+	// that one upload's directories aren't removed from under another.
+	dirMu sync.Mutex
+}
+
+// NewDirStore returns a new DirStore that serves the files under dir
+func NewDirStore(dir string) (*DirStore, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DirStore{root: root}, nil
+}
+
+// Close closes the store's root directory
+func (ds *DirStore) Close() error {
+	return ds.root.Close()
+}
+
+// CanonicalName returns name as a clean path relative to the root, e.g.,
+// "foo/bar" for "/foo/./bar"
+func (ds *DirStore) CanonicalName(name string) string {
+	return canonicalPath(name)
+}
+
+func canonicalPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// cleanName returns the canonical name, refusing names that can't be files
+func cleanName(name string) (string, error) {
+	clean := canonicalPath(name)
+	if clean == "" || strings.HasPrefix(path.Base(clean), stagingPrefix) {
+		return "", fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return clean, nil
+}
+
+// stat returns the info of the regular file name, following symlinks within
+// the root
+func (ds *DirStore) stat(name string) (os.FileInfo, error) {
+	info, err := ds.root.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file: %w", name, os.ErrNotExist)
+	}
+	return info, nil
+}
+
+func (ds *DirStore) Stat(name string) (int64, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return 0, err
+	}
+	info, err := ds.stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Open opens the file.  A file that is replaced while it's open is renamed
+// over, so the open file still reads the old data.
+func (ds *DirStore) Open(name string) (File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ds.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%s is not a regular file: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dirFile{f, info.Size()}, nil
+}
+
+func (ds *DirStore) Create(name string) (StagedFile, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return nil, err
+	}
+	dir := path.Dir(name)
+	tmpName := path.Join(dir, stagingPrefix+hex.EncodeToString(suffix[:]))
+	ds.dirMu.Lock()
+	defer ds.dirMu.Unlock()
+	topDir, err := ds.mkdirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ds.root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		ds.removeDirs(dir, topDir)
+		return nil, err
+	}
+	return &dirStagedFile{store: ds, name: name, tmpName: tmpName, f: f,
+		topDir: topDir}, nil
+}
+
+// mkdirs creates dir and any missing parents, and returns the topmost
+// directory it created ("" if none).  dirMu must be held.
+func (ds *DirStore) mkdirs(dir string) (string, error) {
+	topDir := ""
+	for d := dir; d != "."; d = path.Dir(d) {
+		if _, err := ds.root.Stat(d); err == nil {
+			break
+		}
+		topDir = d
+	}
+	if topDir == "" {
+		return "", nil
+	}
+	if err := ds.root.MkdirAll(dir, 0755); err != nil {
+		ds.removeDirs(dir, topDir)
+		return "", err
+	}
+	return topDir, nil
+}
+
+// removeDirs removes dir and its parents up to topDir, as created by mkdirs,
+// stopping at the first that isn't empty (another upload may be using it).
+// dirMu must be held.
+func (ds *DirStore) removeDirs(dir string, topDir string) {
+	if topDir == "" {
+		return
+	}
+	for d := dir; ; d = path.Dir(d) {
+		err := ds.root.Remove(d)
+		if err != nil && !errors.Is(err, os.ErrNotExist) || d == topDir {
+			return
+		}
+	}
+}
+
+func (ds *DirStore) Delete(name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if _, err := ds.stat(name); err != nil {
+		return err
+	}
+	return ds.root.Remove(name)
+}
+
+// List returns the regular files under the root, including symlinks to them.
+// Entries that can't be read (e.g., a directory without permission) are
+// logged and left out, so that they don't keep the rest from being served.
+func (ds *DirStore) List() ([]string, error) {
+	var names []string
+	err := fs.WalkDir(ds.root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil && name == "." {
+			return err
+		}
+		if err != nil {
+			log.Printf("Skipping %s: %v", name, err)
+			return nil
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), stagingPrefix) {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			names = append(names, name)
+		} else if _, err := ds.stat(name); err == nil {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// A dirFile is a file opened from a DirStore
+type dirFile struct {
+	*os.File
+	size int64
+}
+
+func (f dirFile) Size() int64 {
+	return f.size
+}
+
+// A dirStagedFile is a file being written to a DirStore, in a temp file
+type dirStagedFile struct {
+	store   *DirStore
+	name    string
+	tmpName string
+	f       *os.File
+	// topDir is the topmost directory created for the file ("" if none)
+	topDir string
+}
+
+func (sf *dirStagedFile) Write(p []byte) (int, error) {
+	return sf.f.Write(p)
+}
+
+func (sf *dirStagedFile) Commit() error {
+	err := sf.f.Sync()
+	if closeErr := sf.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = sf.store.root.Rename(sf.tmpName, sf.name)
+	}
+	if err != nil {
+		sf.remove()
+	}
+	return err
+}
+
+func (sf *dirStagedFile) Abort() error {
+	err := sf.f.Close()
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return sf.remove()
+}
+
+// remove removes the temp file and any directories created for it
+func (sf *dirStagedFile) remove() error {
+	sf.store.dirMu.Lock()
+	defer sf.store.dirMu.Unlock()
+	err := sf.store.root.Remove(sf.tmpName)
+	sf.store.removeDirs(path.Dir(sf.tmpName), sf.topDir)
+	return err
+}
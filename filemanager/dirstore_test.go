@@ -0,0 +1,235 @@
+package filemanager
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+func TestDirStore(t *testing.T) {
+	ds, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	testStore(t, ds)
+}
+
+func TestDirStorePaths(t *testing.T) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "root")
+	for name, data := range map[string]string{
+		"secret":            "outside",
+		"root/pxelinux.0":   "boot",
+		"root/cfg/default":  "menu",
+		"root/.tftpdmem-01": "staged"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tmp, name)), 0755)
+		err := os.WriteFile(filepath.Join(tmp, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"escape":   filepath.Join(tmp, "secret"),
+		"relative": "../secret",
+		"inside":   "cfg/default"} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	for name, size := range map[string]int64{
+		"pxelinux.0":        4,
+		"/cfg/default":      4,
+		"cfg/../pxelinux.0": 4,
+		"inside":            4} {
+		if got, err := ds.Stat(name); err != nil || got != size {
+			t.Errorf("%s: size: %d (%v), want: %d", name, got, err, size)
+		}
+	}
+	// ".." can't leave the root, so "../secret" is "secret" in the root
+	for _, name := range []string{"../secret", "escape", "relative", "cfg", ".tftpdmem-01", "/"} {
+		if _, err := ds.Open(name); err == nil {
+			t.Errorf("%s: Expected error opening file", name)
+		}
+	}
+	if _, err := ds.Create("escape/foo"); err == nil {
+		t.Error("Expected error creating file through a symlink out of the root")
+	}
+	names, err := ds.List()
+	sort.Strings(names)
+	want := []string{"cfg/default", "inside", "pxelinux.0"}
+	if err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("names: %v (%v), want: %v", names, err, want)
+	}
+
+	// Uploads can go to new directories
+	f, err := ds.Create("new/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "new/dir/file"))
+	if err != nil || string(data) != "data" {
+		t.Errorf("data: %q (%v), want: %q", data, err, "data")
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "new/dir"))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the committed file, got %d entries", len(entries))
+	}
+}
+
+func TestDirStoreFileManager(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "foo"), []byte("abc"), 0644)
+	ds, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	tfm, err := NewWithStore(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Existing files count against the capacity
+	if tfm.used != 3 {
+		t.Errorf("used: %d, want: 3", tfm.used)
+	}
+	tfm.SetOverwritePolicy(KeepVersioned)
+	if err := tfm.AddFile("foo", []byte("defg")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"foo": "defg", "foo.~1~": "abc"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: data: %q (%v), want: %q", name, data, err, want)
+		}
+	}
+}
+
+func TestDirStoreCanonicalNames(t *testing.T) {
+	ds, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	tfm, err := NewWithStore(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfm.SetOverwritePolicy(Overwrite)
+	tfm.SetPrefixOverwritePolicy("secure/", Reject)
+	tfm.AddFile("foo", []byte("abc"))
+	tfm.AddFile("secure/x", []byte("abc"))
+	tfm.MarkReadOnly("foo")
+
+	// Other names for the same files get the same treatment
+	for _, name := range []string{"/foo", "./foo", "bar/../foo", "/secure/x", "secure//x"} {
+		if tfm.CanWrite(name) {
+			t.Errorf("%s: Expected file to not be writable", name)
+		}
+		if err := tfm.AddFile(name, []byte("hacked")); err == nil {
+			t.Errorf("%s: Expected error replacing file", name)
+		}
+	}
+	if data, _ := tfm.File("foo"); string(data) != "abc" {
+		t.Errorf("File contains %q, want: %q", data, "abc")
+	}
+
+	// And so do writes in progress
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	otherTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5679}
+	opts := TransferOpts{IsWrite: true}
+	if err := tfm.AddConnInfo(1, remoteTid, "/bar", 1, opts); err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.AddConnInfo(2, otherTid, "bar", 1, opts)
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFileExists {
+		t.Errorf("Got err: %#v, want ErrFileExists", err)
+	}
+}
+
+func TestDirStoreAbortRemovesDirs(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "existing"), 0755)
+	ds, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	create := func(name string) StagedFile {
+		sf, err := ds.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sf
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	create("a/b/c").Abort()
+	if exists("a") {
+		t.Error("Expected directories created for an aborted upload to be removed")
+	}
+	create("existing/x").Abort()
+	if !exists("existing") {
+		t.Error("Expected an existing directory to be kept")
+	}
+	// A directory in use by another upload is kept
+	kept := create("a/y")
+	create("a/b/z").Abort()
+	if !exists("a") || exists("a/b") {
+		t.Errorf("a exists: %t, a/b exists: %t, want: true, false",
+			exists("a"), exists("a/b"))
+	}
+	kept.Write([]byte("abc"))
+	if err := kept.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a/y") {
+		t.Error("Expected a/y to be committed")
+	}
+}
+
+func TestDirStoreListUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions don't apply to root")
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "foo"), []byte("abc"), 0644)
+	locked := filepath.Join(dir, "locked")
+	os.Mkdir(locked, 0755)
+	os.WriteFile(filepath.Join(locked, "bar"), []byte("def"), 0644)
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+	ds, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	// The unreadable directory is left out, and the rest is served
+	tfm, err := NewWithStore(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tfm.Filenames(); !reflect.DeepEqual(names, []string{"foo"}) {
+		t.Errorf("Filenames: %v, want: [foo]", names)
+	}
+}
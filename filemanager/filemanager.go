@@ -3,153 +3,293 @@ package filemanager
 import (
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
 
 	"github.com/bgmerrell/tftpdmem/defs"
+	"github.com/bgmerrell/tftpdmem/netascii"
 	errs "github.com/bgmerrell/tftpdmem/server/errors"
 )
 
+// A FileManager manages the files of a Store and the transfers of those files
+// (see transfer.go).
 type FileManager struct {
-	filenameToData map[string]([]byte)
-	fileMu         sync.Mutex
-	tidToConnInfo  map[int]*connInfo
-	connMu         sync.Mutex
+	store         Store
+	fileMu        sync.Mutex
+	tidToConnInfo map[int]*connInfo
+	connMu        sync.Mutex
+	// lastTid is the last TID handed out by NewTid.  It's guarded by
+	// connMu.
+	lastTid int
+	// capacity is the most bytes that can be stored (zero means no
+	// limit).  used counts the bytes in stored files and reserved counts
+	// the bytes set aside for writes in progress.  All three are guarded
+	// by fileMu.
+	capacity int
+	used     int
+	reserved int
+	// policy and prefixPolicies decide whether writes may replace
+	// existing files (see policy.go).  Both are guarded by fileMu.
+	policy         OverwritePolicy
+	prefixPolicies map[string]OverwritePolicy
+	// uploads maps the filenames being written to their reservations
+	// (see policy.go), and conflictPolicy decides what happens to another
+	// write of the same filename meanwhile.  Both are guarded
+	// by fileMu.
+	uploads        map[string]*upload
+	conflictPolicy WriteConflictPolicy
+	// readOnly holds the filenames that clients may not write (see
+	// MarkReadOnly).  It's guarded by fileMu.
+	readOnly map[string]bool
 }
 
-type connInfo struct {
-	filename     string
-	remoteTid    int
-	nextBlockNum uint16
-	data         []byte
+// New returns a new FileManager that keeps its files in memory.
+func New() *FileManager {
+	fm, _ := NewWithStore(NewMemStore())
+	return fm
 }
 
-// New returns a new FileManager.
-func New() *FileManager {
+// NewWithStore returns a new FileManager that keeps its files in store.  The
+// files already in the store count against the capacity.
+func NewWithStore(store Store) (*FileManager, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	used := 0
+	for _, name := range names {
+		size, err := store.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		used += int(size)
+	}
 	return &FileManager{
-		filenameToData: make(map[string]([]byte)),
-		tidToConnInfo:  make(map[int]*connInfo)}
+		store:         store,
+		tidToConnInfo: make(map[int]*connInfo),
+		uploads:       make(map[string]*upload),
+		readOnly:      make(map[string]bool),
+		used:          used}, nil
 }
 
 // NewWithExistingFiles returns a FileManager with prepopulated files.  Handy
 // for testing.
 func NewWithExistingFiles(filenameToData map[string]([]byte)) *FileManager {
-	return &FileManager{
-		filenameToData: filenameToData,
-		tidToConnInfo:  make(map[int]*connInfo)}
+	fm, _ := NewWithStore(&MemStore{files: filenameToData})
+	return fm
 }
 
-// FileExists returns whether or not a file exists
-func (fm *FileManager) FileExists(filename string) bool {
+// Store returns the store that holds the FileManager's files
+func (fm *FileManager) Store() Store {
+	return fm.store
+}
+
+// canonicalName returns the store's canonical name for filename (see
+// Canonicalizer)
+func (fm *FileManager) canonicalName(filename string) string {
+	if c, ok := fm.store.(Canonicalizer); ok {
+		return c.CanonicalName(filename)
+	}
+	return filename
+}
+
+// SetCapacity limits the total number of bytes stored by the FileManager.  A
+// capacity of zero means no limit.
+func (fm *FileManager) SetCapacity(capacity int) {
 	fm.fileMu.Lock()
 	defer fm.fileMu.Unlock()
-	_, ok := fm.filenameToData[filename]
-	return ok
+	fm.capacity = capacity
 }
 
-// AddFile adds a new file with data
-func (fm *FileManager) AddFile(filename string, data []byte) error {
+// Capacity returns the total number of bytes that can be stored (zero means
+// no limit)
+func (fm *FileManager) Capacity() int {
 	fm.fileMu.Lock()
 	defer fm.fileMu.Unlock()
-	_, ok := fm.filenameToData[filename]
-	if ok {
-		return &errs.SrvError{defs.ErrFileExists,
-			fmt.Sprintf("Filename \"%s\" already exists", filename)}
+	return fm.capacity
+}
+
+// fileErr converts an error from the store about filename to a SrvError
+func fileErr(filename string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return &errs.SrvError{Code: defs.ErrFileNotFound,
+			Msg: fmt.Sprintf("Filename \"%s\" does not exists", filename)}
 	}
-	fm.filenameToData[filename] = data
-	return nil
+	return &errs.SrvError{Code: defs.ErrGeneric, Msg: err.Error()}
+}
+
+// FileSize returns the size of a file in bytes
+func (fm *FileManager) FileSize(filename string) (int, error) {
+	filename = fm.canonicalName(filename)
+	size, err := fm.store.Stat(filename)
+	if err != nil {
+		return 0, fileErr(filename, err)
+	}
+	return int(size), nil
+}
+
+// NetasciiFileSize returns the size of a file in bytes once translated to
+// netascii
+func (fm *FileManager) NetasciiFileSize(filename string) (int, error) {
+	data, err := fm.File(filename)
+	if err != nil {
+		return 0, err
+	}
+	return netascii.EncodedLen(data), nil
 }
 
-// AddConnInfo adds connection info by TID pair
-func (fm *FileManager) AddConnInfo(localTid int, remoteTid int, filename string, nextBlockNum uint16) error {
-	fm.connMu.Lock()
-	defer fm.connMu.Unlock()
-	_, ok := fm.tidToConnInfo[localTid]
-	if ok {
-		return errors.New(fmt.Sprintf(
-			"Local TID %d already exists", localTid))
+// reserve sets aside n bytes of capacity.  fileMu must be held.
+func (fm *FileManager) reserve(n int) error {
+	// Written so that a huge n can't overflow
+	if fm.capacity > 0 && n > fm.capacity-fm.used-fm.reserved {
+		return &errs.SrvError{Code: defs.ErrFull,
+			Msg: fmt.Sprintf("Not enough space for %d more bytes", n)}
 	}
-	fm.tidToConnInfo[localTid] = &connInfo{
-		filename, remoteTid, nextBlockNum, []byte{}}
+	fm.reserved += n
 	return nil
 }
 
-// DelConnInfo deletes connection info by TID pair
-func (fm *FileManager) DelConnInfo(localTid int) {
-	fm.connMu.Lock()
-	defer fm.connMu.Unlock()
-	delete(fm.tidToConnInfo, localTid)
+// FileExists returns whether or not a file exists
+func (fm *FileManager) FileExists(filename string) bool {
+	filename = fm.canonicalName(filename)
+	_, err := fm.store.Stat(filename)
+	return err == nil
 }
 
-// Write takes a tid and a blockNum and attempts to write data to a "file"
-// buffer.
-func (fm *FileManager) Write(localTid int, remoteTid int, blockNum uint16, buf []byte) error {
-	fm.connMu.Lock()
-	info, ok := fm.tidToConnInfo[localTid]
-	fm.connMu.Unlock()
-	if !ok {
-		return errors.New(fmt.Sprintf(
-			"No connection info for local TID (%d)", localTid))
+// File returns a copy of a file's data
+func (fm *FileManager) File(filename string) ([]byte, error) {
+	filename = fm.canonicalName(filename)
+	f, err := fm.store.Open(filename)
+	if err != nil {
+		return nil, fileErr(filename, err)
+	}
+	defer f.Close()
+	data, err := readAll(f)
+	if err != nil {
+		return nil, fileErr(filename, err)
 	}
-	if remoteTid != info.remoteTid {
-		return errs.UnexpectedRemoteTidErr{remoteTid, info.remoteTid}
+	return data, nil
+}
+
+// readAll reads the whole of f
+func readAll(f File) ([]byte, error) {
+	data := make([]byte, f.Size())
+	n, err := f.ReadAt(data, 0)
+	if n == len(data) {
+		return data, nil
 	}
-	if fm.FileExists(info.filename) {
-		fm.DelConnInfo(localTid)
-		return &errs.SrvError{defs.ErrFileExists,
-			fmt.Sprintf("Filename \"%s\" already exists", info.filename)}
+	return nil, err
+}
+
+// Filenames returns the names of the stored files in order
+func (fm *FileManager) Filenames() []string {
+	filenames, _ := fm.store.List()
+	sort.Strings(filenames)
+	return filenames
+}
+
+// AddFile adds a new file with data
+func (fm *FileManager) AddFile(filename string, data []byte) error {
+	filename = fm.canonicalName(filename)
+	f, err := fm.store.Create(filename)
+	if err != nil {
+		return fileErr(filename, err)
 	}
-	if blockNum != info.nextBlockNum {
-		fm.DelConnInfo(localTid)
-		return errors.New(fmt.Sprintf(
-			"Got block %d, want %d", blockNum, info.nextBlockNum))
+	_, err = f.Write(data)
+	if err != nil {
+		f.Abort()
+		return fileErr(filename, err)
 	}
-	info.data = append(info.data, buf...)
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	return fm.commit(filename, f, len(data), 0)
+}
 
-	// Not done yet...
-	if len(buf) == defs.BlockSize {
-		info.nextBlockNum++
-		return nil
+// Delete deletes a file, and with it any read-only mark
+func (fm *FileManager) Delete(filename string) error {
+	filename = fm.canonicalName(filename)
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	size, err := fm.store.Stat(filename)
+	if err == nil {
+		err = fm.store.Delete(filename)
+	}
+	if err != nil {
+		return fileErr(filename, err)
 	}
+	fm.used -= int(size)
+	delete(fm.readOnly, filename)
+	return nil
+}
 
-	// Done
-	err := fm.AddFile(info.filename, info.data)
+// commit commits staged file f of size bytes as filename, which may use up to
+// reserved bytes of previously reserved capacity.  An existing file is
+// replaced if the overwrite policy allows it.  f is aborted if it can't be
+// committed.  fileMu must be held.
+func (fm *FileManager) commit(filename string, f StagedFile, size int, reserved int) error {
+	if err := fm.checkWrite(filename); err != nil {
+		f.Abort()
+		return err
+	}
+	oldSize, err := fm.store.Stat(filename)
+	exists := err == nil
+	policy := fm.overwritePolicy(filename)
+	// Overwriting frees the old file's space
+	freed := 0
+	if exists && policy == Overwrite {
+		freed = int(oldSize)
+	}
+	fm.reserved -= reserved
+	fm.used -= freed
+	err = fm.reserve(size)
+	versioned := ""
+	if err == nil {
+		fm.reserved -= size
+		if exists && policy == KeepVersioned {
+			versioned = fm.versionedName(filename)
+			err = fm.copyFile(filename, versioned)
+		}
+	}
+	if err == nil {
+		// Reads in progress hold on to the old data, so replacing it
+		// is atomic as far as clients can tell.
+		err = f.Commit()
+		if err != nil {
+			if versioned != "" {
+				fm.store.Delete(versioned)
+			}
+			err = fileErr(filename, err)
+		}
+	}
 	if err != nil {
-		fm.DelConnInfo(localTid)
+		f.Abort()
+		fm.reserved += reserved
+		fm.used += freed
 		return err
 	}
+	fm.used += size
 	return nil
 }
 
-// Read takes a tid and a blockNum and attempts to read data from a "file"
-// buffer.
-func (fm *FileManager) Read(localTid int, remoteTid int, blockNum uint16) ([]byte, error) {
-	fm.connMu.Lock()
-	info, ok := fm.tidToConnInfo[localTid]
-	fm.connMu.Unlock()
-	if !ok {
-		return nil, errors.New(fmt.Sprintf(
-			"No connection info for local TID (%d)", localTid))
-	}
-	if remoteTid != info.remoteTid {
-		return nil, errs.UnexpectedRemoteTidErr{remoteTid, info.remoteTid}
-	}
-	if blockNum != info.nextBlockNum {
-		fm.DelConnInfo(localTid)
-		return nil, errors.New(fmt.Sprintf(
-			"Got block %d, want %d", blockNum, info.nextBlockNum))
-	}
-	data := fm.filenameToData[info.filename]
-	startIdx := int(blockNum) * int(defs.BlockSize)
-	endIdx := startIdx + int(defs.BlockSize)
-	// A final ACK will put the startIdx out of bounds, and we don't need
-	// to respond to it.
-	if startIdx > len(data) {
-		fm.DelConnInfo(localTid)
-		return nil, nil
-	} else if endIdx > len(data) {
-		endIdx = len(data)
-	}
-	info.nextBlockNum++
-
-	return data[startIdx:endIdx], nil
+// copyFile copies file src to dst
+func (fm *FileManager) copyFile(src string, dst string) error {
+	data, err := fm.File(src)
+	if err != nil {
+		return err
+	}
+	f, err := fm.store.Create(dst)
+	if err != nil {
+		return fileErr(dst, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Commit()
+	} else {
+		f.Abort()
+	}
+	if err != nil {
+		return fileErr(dst, err)
+	}
+	return nil
 }
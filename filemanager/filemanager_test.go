@@ -2,6 +2,11 @@ package filemanager
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -12,7 +17,7 @@ import (
 func TestFileExistsTrue(t *testing.T) {
 	name := "foo"
 	tfm := New()
-	tfm.filenameToData = map[string][]byte{name: []byte{}}
+	tfm.store = &MemStore{files: map[string][]byte{name: []byte{}}}
 	exists := tfm.FileExists(name)
 	if !exists {
 		t.Errorf("Expected filename \"%s\" to exist", name)
@@ -22,7 +27,7 @@ func TestFileExistsTrue(t *testing.T) {
 func TestFileExistsFalse(t *testing.T) {
 	name := "foo"
 	tfm := New()
-	tfm.filenameToData = map[string][]byte{}
+	tfm.store = &MemStore{files: map[string][]byte{}}
 	exists := tfm.FileExists(name)
 	if exists {
 		t.Errorf("Expected filename \"%s\" to not exist", name)
@@ -32,7 +37,7 @@ func TestFileExistsFalse(t *testing.T) {
 func TestAddFile(t *testing.T) {
 	name := "foo"
 	tfm := New()
-	tfm.filenameToData = map[string][]byte{}
+	tfm.store = &MemStore{files: map[string][]byte{}}
 	err := tfm.AddFile(name, []byte{'a', 'b', 'c'})
 	if err != nil {
 		t.Fatal(err)
@@ -41,7 +46,7 @@ func TestAddFile(t *testing.T) {
 	if !exists {
 		t.Errorf("Expected filename \"%s\" to exist", name)
 	}
-	bytes := tfm.filenameToData[name]
+	bytes := memFiles(tfm)[name]
 	expected := "abc"
 	if string(bytes) != expected {
 		t.Errorf("File contains %q, want: %q", bytes, expected)
@@ -51,7 +56,7 @@ func TestAddFile(t *testing.T) {
 func TestAddFileFail(t *testing.T) {
 	name := "foo"
 	tfm := New()
-	tfm.filenameToData = map[string][]byte{}
+	tfm.store = &MemStore{files: map[string][]byte{}}
 	err := tfm.AddFile(name, []byte{'a', 'b', 'c'})
 	if err != nil {
 		t.Fatal(err)
@@ -60,7 +65,7 @@ func TestAddFileFail(t *testing.T) {
 	if err == nil {
 		t.Errorf("Expected error adding \"%s\" for second time", name)
 	}
-	bytes := tfm.filenameToData[name]
+	bytes := memFiles(tfm)[name]
 	expected := "abc"
 	if string(bytes) != expected {
 		t.Errorf("File contains %q, want: %q", bytes, expected)
@@ -69,67 +74,73 @@ func TestAddFileFail(t *testing.T) {
 
 func TestAddConnInfo(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	nextBlockNum := uint16(9)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	expected := &connInfo{filename, remoteTid, nextBlockNum, []byte{}}
+	expected := &connInfo{
+		filename:     filename,
+		remoteAddr:   remoteTid,
+		nextBlockNum: uint64(nextBlockNum)}
 	ci := tfm.tidToConnInfo[localTid]
 	if ci.filename != expected.filename {
 		t.Errorf("filename: %s, want: %s", ci.filename, expected.filename)
 	}
-	if ci.remoteTid != expected.remoteTid {
-		t.Errorf("remote tid: %d, want: %d", ci.remoteTid, expected.remoteTid)
+	if ci.remoteAddr != expected.remoteAddr {
+		t.Errorf("remote addr: %s, want: %s", ci.remoteAddr, expected.remoteAddr)
 	}
 	if ci.nextBlockNum != expected.nextBlockNum {
 		t.Errorf("nextBlockNum: %d, want: %d", ci.nextBlockNum, expected.nextBlockNum)
 	}
-	if bytes.Compare(ci.data, expected.data) != 0 {
-		t.Errorf("filename: %#v, want: %#v", ci.data, expected.data)
+	if ci.written != expected.written {
+		t.Errorf("written: %d, want: %d", ci.written, expected.written)
 	}
 }
 
 func TestAddConnInfoFail(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	nextBlockNum := uint16(9)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err = tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err == nil {
 		t.Fatal("Expected error adding conn info a second time")
 	}
-	expected := &connInfo{filename, remoteTid, nextBlockNum, []byte{}}
+	expected := &connInfo{
+		filename:     filename,
+		remoteAddr:   remoteTid,
+		nextBlockNum: uint64(nextBlockNum)}
 	ci := tfm.tidToConnInfo[localTid]
 	if ci.filename != expected.filename {
 		t.Errorf("filename: %s, want: %s", ci.filename, expected.filename)
 	}
-	if ci.remoteTid != expected.remoteTid {
-		t.Errorf("remote tid: %d, want: %d", ci.remoteTid, expected.remoteTid)
+	if ci.remoteAddr != expected.remoteAddr {
+		t.Errorf("remote addr: %s, want: %s", ci.remoteAddr, expected.remoteAddr)
 	}
 	if ci.nextBlockNum != expected.nextBlockNum {
 		t.Errorf("nextBlockNum: %d, want: %d", ci.nextBlockNum, expected.nextBlockNum)
 	}
-	if bytes.Compare(ci.data, expected.data) != 0 {
-		t.Errorf("filename: %#v, want: %#v", ci.data, expected.data)
+	if ci.written != expected.written {
+		t.Errorf("written: %d, want: %d", ci.written, expected.written)
 	}
 }
 
 func TestDelConnInfo(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	nextBlockNum := uint16(9)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,21 +153,21 @@ func TestDelConnInfo(t *testing.T) {
 
 func TestWrite(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	inData := []byte("abc")
 	nextBlockNum := uint16(9)
 	blockNum := uint16(9)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = tfm.Write(localTid, remoteTid, blockNum, inData)
-	if err != nil {
+	_, _, err = tfm.Write(localTid, remoteTid, blockNum, inData)
+	if err != errs.ErrTransferDone {
 		t.Error(err)
 	}
-	outData := tfm.filenameToData[filename]
+	outData := memFiles(tfm)[filename]
 	if bytes.Compare(inData, outData) != 0 {
 		t.Errorf("read: %#v, want: %#v", outData, inData)
 	}
@@ -164,7 +175,7 @@ func TestWrite(t *testing.T) {
 
 func TestWriteMultiple(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	blockSizedStr := strings.Repeat("a", defs.BlockSize)
 	inData1 := []byte(blockSizedStr)
@@ -173,20 +184,20 @@ func TestWriteMultiple(t *testing.T) {
 	nextBlockNum := uint16(9)
 	blockNum := uint16(9)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = tfm.Write(localTid, remoteTid, blockNum, inData1)
+	_, _, err = tfm.Write(localTid, remoteTid, blockNum, inData1)
 	if err != nil {
 		t.Error(err)
 	}
 	blockNum++
-	err = tfm.Write(localTid, remoteTid, blockNum, inData2)
-	if err != nil {
+	_, _, err = tfm.Write(localTid, remoteTid, blockNum, inData2)
+	if err != errs.ErrTransferDone {
 		t.Error(err)
 	}
-	outData := tfm.filenameToData[filename]
+	outData := memFiles(tfm)[filename]
 	if bytes.Compare(outData, expectedData) != 0 {
 		t.Errorf("read: %#v, want: %#v", outData, expectedData)
 	}
@@ -194,11 +205,11 @@ func TestWriteMultiple(t *testing.T) {
 
 func TestWriteNoConnInfo(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	inData := []byte("abc")
 	blockNum := uint16(9)
 	tfm := New()
-	err := tfm.Write(localTid, remoteTid, blockNum, inData)
+	_, _, err := tfm.Write(localTid, remoteTid, blockNum, inData)
 	if err == nil {
 		t.Error("Expected failure writing to file w/o conn info")
 	}
@@ -206,18 +217,18 @@ func TestWriteNoConnInfo(t *testing.T) {
 
 func TestWriteFileExists(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	inData := []byte("abc")
 	nextBlockNum := uint16(9)
 	blockNum := uint16(9)
 	tfm := New()
-	tfm.filenameToData = map[string][]byte{filename: []byte{}}
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	tfm.store = &MemStore{files: map[string][]byte{filename: []byte{}}}
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = tfm.Write(localTid, remoteTid, blockNum, inData)
+	_, _, err = tfm.Write(localTid, remoteTid, blockNum, inData)
 	if err == nil {
 		t.Error("Expected failure due to existing file")
 	}
@@ -225,7 +236,7 @@ func TestWriteFileExists(t *testing.T) {
 
 func TestWriteBadBlockNum(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	blockSizedStr := strings.Repeat("a", defs.BlockSize)
 	inData1 := []byte(blockSizedStr)
@@ -233,45 +244,76 @@ func TestWriteBadBlockNum(t *testing.T) {
 	nextBlockNum := uint16(9)
 	blockNum := uint16(9)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = tfm.Write(localTid, remoteTid, blockNum, inData1)
+	_, _, err = tfm.Write(localTid, remoteTid, blockNum, inData1)
 	if err != nil {
 		t.Error(err)
 	}
-	err = tfm.Write(localTid, remoteTid, blockNum, inData2)
+	_, _, err = tfm.Write(localTid, remoteTid, blockNum+2, inData2)
 	if err == nil {
 		t.Error("Expected error writing wrong block number")
 	}
 }
 
+func TestWriteDuplicate(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	blockSizedStr := strings.Repeat("a", defs.BlockSize)
+	nextBlockNum := uint16(9)
+	tfm := New()
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ackNum, ack, err := tfm.Write(localTid, remoteTid, 9, []byte(blockSizedStr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The duplicate is acknowledged again
+		if !ack || ackNum != 9 {
+			t.Errorf("ack: %t (%d), want: true (9)", ack, ackNum)
+		}
+	}
+	_, _, err = tfm.Write(localTid, remoteTid, 10, []byte("test"))
+	if err != errs.ErrTransferDone {
+		t.Fatal(err)
+	}
+	expected := blockSizedStr + "test"
+	if string(memFiles(tfm)[filename]) != expected {
+		t.Errorf("File contains %q, want: %q", memFiles(tfm)[filename], expected)
+	}
+}
+
 func TestRead(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	inData := []byte("abc")
 	blockNum := uint16(0)
 	nextBlockNum := uint16(0)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	tfm.filenameToData["foo"] = inData
-	outData, err := tfm.Read(localTid, remoteTid, blockNum)
+	memFiles(tfm)["foo"] = inData
+	blocks, err := tfm.Read(localTid, remoteTid, blockNum)
 	if err != nil {
 		t.Error(err)
 	}
-	if bytes.Compare(inData, outData) != 0 {
-		t.Errorf("read: %#v, want: %#v", outData, inData)
+	if len(blocks) != 1 || bytes.Compare(blocks[0].Data, inData) != 0 {
+		t.Errorf("read: %#v, want: %#v", blocks, [][]byte{inData})
 	}
 }
 
 func TestReadNoConnInfo(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	blockNum := uint16(0)
 	tfm := New()
 	_, err := tfm.Read(localTid, remoteTid, blockNum)
@@ -282,27 +324,53 @@ func TestReadNoConnInfo(t *testing.T) {
 
 func TestReadWrongRemoteTid(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
-	remoteTidBad := 5680
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	remoteTidBad := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5680}
 	filename := "foo"
 	inData := []byte("abc")
 	blockNum := uint16(0)
 	nextBlockNum := uint16(0)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	tfm.filenameToData["foo"] = inData
+	memFiles(tfm)["foo"] = inData
 	_, err = tfm.Read(localTid, remoteTidBad, blockNum)
 	if _, ok := err.(errs.UnexpectedRemoteTidErr); !ok {
 		t.Error("Expected UnexpectedRemoteTidErr from mismatched remote tids")
 	}
 }
 
+func TestReadWrongRemoteHost(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	// Same port, different host
+	remoteTidBad := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5678}
+	filename := "foo"
+	inData := []byte("abc")
+	tfm := NewWithExistingFiles(map[string][]byte{filename: inData})
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 0, TransferOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tfm.Read(localTid, remoteTidBad, 0)
+	if _, ok := err.(errs.UnexpectedRemoteTidErr); !ok {
+		t.Error("Expected UnexpectedRemoteTidErr from mismatched remote hosts")
+	}
+	// The transfer carries on
+	blocks, err := tfm.Read(localTid, remoteTid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || bytes.Compare(blocks[0].Data, inData) != 0 {
+		t.Errorf("read: %#v, want: %#v", blocks, [][]byte{inData})
+	}
+}
+
 func TestReadMultiple(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	blockSizedStr := strings.Repeat("a", defs.BlockSize)
 	expectedData1 := []byte(blockSizedStr)
@@ -311,37 +379,37 @@ func TestReadMultiple(t *testing.T) {
 	nextBlockNum := uint16(0)
 	blockNum := uint16(0)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	tfm.filenameToData[filename] = inData
-	outData, err := tfm.Read(localTid, remoteTid, blockNum)
+	memFiles(tfm)[filename] = inData
+	blocks, err := tfm.Read(localTid, remoteTid, blockNum)
 	if err != nil {
 		t.Error(err)
 	}
-	if bytes.Compare(outData, expectedData1) != 0 {
-		t.Errorf("read: %#v, want: %#v", outData, expectedData1)
+	if len(blocks) != 1 || bytes.Compare(blocks[0].Data, expectedData1) != 0 {
+		t.Errorf("read: %#v, want: %#v", blocks, [][]byte{expectedData1})
 	}
 	blockNum++
-	outData, err = tfm.Read(localTid, remoteTid, blockNum)
+	blocks, err = tfm.Read(localTid, remoteTid, blockNum)
 	if err != nil {
 		t.Error(err)
 	}
-	if bytes.Compare(outData, expectedData2) != 0 {
-		t.Errorf("read: %#v, want: %#v", outData, expectedData2)
+	if len(blocks) != 1 || bytes.Compare(blocks[0].Data, expectedData2) != 0 {
+		t.Errorf("read: %#v, want: %#v", blocks, [][]byte{expectedData2})
 	}
 	// Simulate the final ACK
 	blockNum++
-	outData, err = tfm.Read(localTid, remoteTid, blockNum)
-	if outData != nil || err != nil {
-		t.Errorf("Got outData: %#v, err: %#v.  Want nil for both", outData, err)
+	blocks, err = tfm.Read(localTid, remoteTid, blockNum)
+	if blocks != nil || err != errs.ErrTransferDone {
+		t.Errorf("Got blocks: %#v, err: %#v.  Want nil and ErrTransferDone", blocks, err)
 	}
 }
 
 func TestReadBadBlock(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
 	filename := "foo"
 	blockSizedStr := strings.Repeat("a", defs.BlockSize)
 	expectedData1 := []byte(blockSizedStr)
@@ -349,39 +417,478 @@ func TestReadBadBlock(t *testing.T) {
 	nextBlockNum := uint16(0)
 	blockNum := uint16(0)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	tfm.filenameToData[filename] = inData
-	outData, err := tfm.Read(localTid, remoteTid, blockNum)
+	memFiles(tfm)[filename] = inData
+	blocks, err := tfm.Read(localTid, remoteTid, blockNum)
 	if err != nil {
 		t.Error(err)
 	}
-	if bytes.Compare(outData, expectedData1) != 0 {
-		t.Errorf("read: %#v, want: %#v", outData, expectedData1)
+	if len(blocks) != 1 || bytes.Compare(blocks[0].Data, expectedData1) != 0 {
+		t.Errorf("read: %#v, want: %#v", blocks, [][]byte{expectedData1})
 	}
-	_, err = tfm.Read(localTid, remoteTid, blockNum)
-	if err == nil {
-		t.Error("Expected error reading wrong block number")
+	_, err = tfm.Read(localTid, remoteTid, blockNum+2)
+	if err == nil || err == errs.ErrPacketIgnored {
+		t.Errorf("err: %#v, want error reading wrong block number", err)
+	}
+}
+
+func TestReadDuplicate(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	blockSizedStr := strings.Repeat("a", defs.BlockSize)
+	tfm := NewWithExistingFiles(
+		map[string][]byte{filename: []byte(blockSizedStr + "test")})
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 0, TransferOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tfm.Read(localTid, remoteTid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A duplicate ACK gets no response...
+	blocks, err := tfm.Read(localTid, remoteTid, 0)
+	if blocks != nil || err != errs.ErrPacketIgnored {
+		t.Errorf("Got blocks: %#v, err: %#v.  Want nil and ErrPacketIgnored", blocks, err)
+	}
+	// ...and doesn't disturb the transfer
+	blocks, err = tfm.Read(localTid, remoteTid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || string(blocks[0].Data) != "test" {
+		t.Errorf("read: %v, want: %q", blocks, "test")
 	}
 }
 
 func TestWriteWrongRemoteTid(t *testing.T) {
 	localTid := 1234
-	remoteTid := 5678
-	remoteTidBad := 5680
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	remoteTidBad := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5680}
 	filename := "foo"
 	inData := []byte("abc")
 	blockNum := uint16(0)
 	nextBlockNum := uint16(0)
 	tfm := New()
-	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum)
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, nextBlockNum, TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = tfm.Write(localTid, remoteTidBad, blockNum, inData)
+	_, _, err = tfm.Write(localTid, remoteTidBad, blockNum, inData)
 	if _, ok := err.(errs.UnexpectedRemoteTidErr); !ok {
 		t.Error("Expected UnexpectedRemoteTidErr from mismatched remote tids")
 	}
 }
+
+func TestReadWriteBlockSize(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	opts := TransferOpts{BlockSize: 8}
+	tfm := New()
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A full block doesn't finish the write...
+	_, _, err = tfm.Write(localTid, remoteTid, 1, []byte("abcdefgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfm.FileExists(filename) {
+		t.Fatalf("Expected filename \"%s\" to not exist yet", filename)
+	}
+	// ...but a short one does
+	_, _, err = tfm.Write(localTid, remoteTid, 2, []byte("ij"))
+	if err != errs.ErrTransferDone {
+		t.Fatal(err)
+	}
+	tfm.DelConnInfo(localTid)
+
+	err = tfm.AddConnInfo(localTid, remoteTid, filename, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"abcdefgh", "ij"} {
+		blocks, err := tfm.Read(localTid, remoteTid, uint16(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blocks) != 1 || string(blocks[0].Data) != expected {
+			t.Errorf("read: %v, want: %q", blocks, expected)
+		}
+	}
+}
+
+func TestAddConnInfoFull(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	tfm := NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	tfm.SetCapacity(10)
+	err := tfm.AddConnInfo(1234, remoteTid, "bar", 1, TransferOpts{TransferSize: 8})
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFull {
+		t.Fatalf("Got err: %#v, want ErrFull", err)
+	}
+	err = tfm.AddConnInfo(1234, remoteTid, "bar", 1, TransferOpts{TransferSize: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reservation leaves no room for anyone else
+	err = tfm.AddConnInfo(1235, remoteTid, "baz", 1, TransferOpts{TransferSize: 1})
+	if err == nil {
+		t.Fatal("Expected error reserving more than the capacity")
+	}
+	// Even a size that would overflow the sum
+	err = tfm.AddConnInfo(1235, remoteTid, "baz", 1, TransferOpts{TransferSize: math.MaxInt})
+	if err == nil {
+		t.Fatal("Expected error reserving math.MaxInt bytes")
+	}
+	// Until it's released
+	tfm.DelConnInfo(1234)
+	err = tfm.AddConnInfo(1235, remoteTid, "baz", 1, TransferOpts{TransferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.AddConnInfo(1236, remoteTid, "qux", 1, TransferOpts{TransferSize: math.MaxInt})
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFull {
+		t.Fatalf("Got err: %#v, want ErrFull", err)
+	}
+}
+
+func TestWriteFull(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	tfm := New()
+	tfm.SetCapacity(10)
+	opts := TransferOpts{BlockSize: 8, TransferSize: 2}
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client sends more than it announced, which is OK while there's
+	// room...
+	_, _, err = tfm.Write(localTid, remoteTid, 1, []byte("abcdefgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ...but not after
+	_, _, err = tfm.Write(localTid, remoteTid, 2, []byte("ijk"))
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFull {
+		t.Fatalf("Got err: %#v, want ErrFull", err)
+	}
+	if _, ok := tfm.tidToConnInfo[localTid]; ok {
+		t.Error("Expected no conn info for local tid:", localTid)
+	}
+	if tfm.reserved != 0 {
+		t.Errorf("reserved: %d, want: 0", tfm.reserved)
+	}
+}
+
+func TestFileSize(t *testing.T) {
+	tfm := NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	size, err := tfm.FileSize("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 3 {
+		t.Errorf("size: %d, want: 3", size)
+	}
+	_, err = tfm.FileSize("bar")
+	if err == nil {
+		t.Error("Expected error getting size of missing file")
+	}
+}
+
+func TestReadWindow(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	opts := TransferOpts{BlockSize: 8, WindowSize: 3}
+	tfm := NewWithExistingFiles(
+		map[string][]byte{filename: []byte("abcdefghijklmnopqrst")})
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ackNum   uint16
+		expected []string
+	}{
+		{0, []string{"abcdefgh", "ijklmnop", "qrst"}},
+		// The client missed block 2, so start over from there
+		{1, []string{"ijklmnop", "qrst"}},
+	}
+	for _, test := range tests {
+		blocks, err := tfm.Read(localTid, remoteTid, test.ackNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blocks) != len(test.expected) {
+			t.Fatalf("read: %v, want: %q", blocks, test.expected)
+		}
+		for i := range blocks {
+			if string(blocks[i].Data) != test.expected[i] {
+				t.Errorf("read: %v, want: %q", blocks, test.expected)
+			}
+		}
+	}
+	_, err = tfm.Read(localTid, remoteTid, 3)
+	if err != errs.ErrTransferDone {
+		t.Errorf("err: %#v, want ErrTransferDone", err)
+	}
+}
+
+func TestWriteWindow(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	opts := TransferOpts{BlockSize: 8, WindowSize: 2}
+	tfm := New()
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		blockNum uint16
+		data     string
+		ack      bool
+		ackNum   uint16
+	}{
+		{1, "abcdefgh", false, 0},
+		// End of the window
+		{2, "ijklmnop", true, 2},
+		// Block 3 was lost, so resync once...
+		{4, "yyyyyyyy", true, 2},
+		// ...and ignore any stragglers
+		{4, "yyyyyyyy", false, 0},
+		{3, "qrstuvwx", false, 0},
+		// A short block always gets an ACK
+		{4, "yz", true, 4},
+	}
+	for _, test := range tests {
+		ackNum, ack, err := tfm.Write(
+			localTid, remoteTid, test.blockNum, []byte(test.data))
+		if err != nil && err != errs.ErrTransferDone &&
+			err != errs.ErrPacketIgnored {
+			t.Fatal(err)
+		}
+		if ack != test.ack || ackNum != test.ackNum {
+			t.Errorf("block %d: ack: %t (%d), want: %t (%d)",
+				test.blockNum, ack, ackNum, test.ack, test.ackNum)
+		}
+	}
+	expected := "abcdefghijklmnopqrstuvwxyz"
+	if string(memFiles(tfm)[filename]) != expected {
+		t.Errorf("File contains %q, want: %q", memFiles(tfm)[filename], expected)
+	}
+}
+
+func TestReadWriteRollover(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	const numBlocks = 70000
+	for _, rollover := range []int{0, 1} {
+		opts := TransferOpts{BlockSize: 8, Rollover: rollover}
+		tfm := New()
+		err := tfm.AddConnInfo(localTid, remoteTid, filename, 1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each block holds its own logical block number
+		for i := uint64(1); i <= numBlocks; i++ {
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, i)
+			if i == numBlocks {
+				buf = buf[:4]
+			}
+			_, _, err = tfm.Write(localTid, remoteTid,
+				wireBlockNum(i, rollover), buf)
+			if err != nil && err != errs.ErrTransferDone {
+				t.Fatalf("rollover %d, block %d: %s", rollover, i, err)
+			}
+		}
+		data := memFiles(tfm)[filename]
+		if len(data) != (numBlocks-1)*8+4 {
+			t.Fatalf("File is %d bytes, want: %d", len(data), (numBlocks-1)*8+4)
+		}
+
+		err = tfm.AddConnInfo(localTid, remoteTid, filename, 0, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ackNum := uint16(0)
+		for i := uint64(1); i < numBlocks; i++ {
+			blocks, err := tfm.Read(localTid, remoteTid, ackNum)
+			if err != nil {
+				t.Fatalf("rollover %d, block %d: %s", rollover, i, err)
+			}
+			if blocks[0].Num != wireBlockNum(i, rollover) ||
+				binary.BigEndian.Uint64(blocks[0].Data) != i {
+				t.Fatalf("rollover %d: got block %d (%x), want %d",
+					rollover, blocks[0].Num, blocks[0].Data, i)
+			}
+			ackNum = blocks[0].Num
+		}
+	}
+}
+
+func TestReadWriteNetascii(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	opts := TransferOpts{BlockSize: 8, Netascii: true}
+	tfm := New()
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The CR LF and CR NUL straddle the blocks
+	for i, block := range []string{"abcdefg\r", "\nhijklm\r", "\x00"} {
+		_, _, err = tfm.Write(localTid, remoteTid, uint16(i+1), []byte(block))
+		if err != nil && err != errs.ErrTransferDone {
+			t.Fatal(err)
+		}
+	}
+	expected := "abcdefg\nhijklm\r"
+	if string(memFiles(tfm)[filename]) != expected {
+		t.Errorf("File contains %q, want: %q", memFiles(tfm)[filename], expected)
+	}
+	size, err := tfm.NetasciiFileSize(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 17 {
+		t.Errorf("size: %d, want: 17", size)
+	}
+
+	err = tfm.AddConnInfo(localTid, remoteTid, filename, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"abcdefg\r", "\nhijklm\r", "\x00"} {
+		blocks, err := tfm.Read(localTid, remoteTid, uint16(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blocks) != 1 || string(blocks[0].Data) != expected {
+			t.Errorf("read: %v, want: %q", blocks, expected)
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	tfm := New()
+	tfm.SetCapacity(10)
+	opts := TransferOpts{BlockSize: 8, TransferSize: 10}
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.Abort(localTid, &net.UDPAddr{IP: remoteTid.IP, Port: 5679})
+	if _, ok := err.(errs.UnexpectedRemoteTidErr); !ok {
+		t.Error("Expected UnexpectedRemoteTidErr from mismatched remote tids")
+	}
+	err = tfm.Abort(localTid, remoteTid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tfm.tidToConnInfo[localTid]; ok {
+		t.Error("Expected no conn info for local tid:", localTid)
+	}
+	if tfm.reserved != 0 {
+		t.Errorf("reserved: %d, want: 0", tfm.reserved)
+	}
+}
+
+func TestDescribeTransfer(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	tfm := NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	if desc := tfm.DescribeTransfer(1); desc != "" {
+		t.Errorf("desc: %q, want none", desc)
+	}
+	err := tfm.AddConnInfo(1, remoteTid, "foo", 0, TransferOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.AddConnInfo(3, remoteTid, "baz", 1, TransferOpts{IsWrite: true, BlockSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = tfm.Write(3, remoteTid, 1, []byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tid, want := range map[int]string{
+		1: `read of "foo" by 127.0.0.1:5678 (at block 0)`,
+		3: `write of "baz" from 127.0.0.1:5678 (2 bytes received)`} {
+		if desc := tfm.DescribeTransfer(tid); desc != want {
+			t.Errorf("desc: %q, want: %q", desc, want)
+		}
+	}
+}
+
+func TestDescribeTransferWhileWriting(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	tfm := New()
+	err := tfm.AddConnInfo(1, remoteTid, "foo", 1, TransferOpts{IsWrite: true, BlockSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for block := uint16(1); block <= 100; block++ {
+			if _, _, err := tfm.Write(1, remoteTid, block, []byte("ab")); err != nil {
+				t.Error(err)
+				return
+			}
+			// Describe between writes, even on a single CPU
+			runtime.Gosched()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			want := `write of "foo" from 127.0.0.1:5678 (200 bytes received)`
+			if desc := tfm.DescribeTransfer(1); desc != want {
+				t.Errorf("desc: %q, want: %q", desc, want)
+			}
+			return
+		default:
+			tfm.DescribeTransfer(1)
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	tfm := NewWithExistingFiles(map[string][]byte{"foo": []byte("abc"), "bar": nil})
+	data, err := tfm.File("foo")
+	if err != nil || string(data) != "abc" {
+		t.Errorf("data: %q (%v), want: %q", data, err, "abc")
+	}
+	// The data is a copy
+	data[0] = 'x'
+	if data, _ := tfm.File("foo"); string(data) != "abc" {
+		t.Errorf("data: %q, want: %q", data, "abc")
+	}
+	if _, err := tfm.File("baz"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+	if filenames := tfm.Filenames(); !reflect.DeepEqual(filenames, []string{"bar", "foo"}) {
+		t.Errorf("filenames: %v, want: [bar foo]", filenames)
+	}
+}
+
+// memFiles returns the files of a FileManager with a MemStore
+func memFiles(fm *FileManager) map[string][]byte {
+	return fm.store.(*MemStore).files
+}
@@ -0,0 +1,451 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A journal records every change to the files, so that a store that keeps its
+// files in memory can be rebuilt after a crash.  All integers are big endian.
+// The format is:
+//
+//	magic   "TFTPDJNL"
+//	version uint16 (journalVersion)
+//	entries (see writeEntry)
+const (
+	journalMagic   = "TFTPDJNL"
+	journalVersion = 1
+	opWrite        = 'W'
+	opDelete       = 'D'
+)
+
+// ErrCorruptJournal is returned (wrapped) when a journal can't be replayed
+// because an entry before its end is damaged
+var ErrCorruptJournal = errors.New("Corrupt journal")
+
+// A JournalStore is a Store that appends each committed file and each
+// deletion to a journal, and syncs it, before passing it on to another store.
+// Opening a JournalStore replays the journal into that store, so a MemStore
+// wrapped in a JournalStore keeps its files through a crash.  Once the journal
+// grows past a threshold it's compacted down to the current files.
+type JournalStore struct {
+	store    Store
+	filename string
+	// threshold is the journal size that triggers compaction, though it
+	// waits until the journal has at least doubled since the last one, so
+	// that files adding up to more than the threshold don't compact on
+	// every write.
+	threshold int64
+	// mu guards the rest and is held while changes are passed on to the
+	// store, so that the journal and the store change in the same order.
+	mu        sync.Mutex
+	f         *os.File
+	size      int64
+	compacted int64
+}
+
+// NewJournalStore returns a new JournalStore that journals the changes to
+// store in the file filename, compacting it past threshold bytes (zero means
+// never).  An existing journal is verified and then replayed into store.  An
+// entry cut short at the end of the journal, as left by a crash while
+// appending it, is dropped, but a damaged entry anywhere else is refused (see
+// ErrCorruptJournal), leaving the journal as it is.
+func NewJournalStore(filename string, store Store, threshold int64) (*JournalStore, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	size, err := replay(f, store)
+	if err == nil && size == 0 {
+		// Reading left the offset somewhere, and a header cut short is
+		// written over
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			size, err = writeJournalHeader(f)
+		}
+	}
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &JournalStore{store: store, filename: filename, threshold: threshold,
+		f: f, size: size, compacted: size}, nil
+}
+
+// replay verifies the whole of journal f and only then applies its entries to
+// store.  It returns the size of the journal up to the end of the last whole
+// entry (zero if it's missing its header).
+func replay(f *os.File, store Store) (int64, error) {
+	size, err := readJournal(f, nil)
+	if err != nil || size == 0 {
+		return size, err
+	}
+	return readJournal(f, func(op byte, name string, data []byte) error {
+		if op == opWrite {
+			return putFile(store, name, data)
+		}
+		err := store.Delete(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+// readJournal reads journal f from the start, passing each entry to apply (if
+// it isn't nil), and returns the size of the journal up to the end of the last
+// whole entry
+func readJournal(f *os.File, apply func(op byte, name string, data []byte) error) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := &countingReader{r: bufio.NewReader(f)}
+	header := make([]byte, len(journalMagic)+2)
+	n, err := io.ReadFull(r, header)
+	if err != nil && bytes.HasPrefix([]byte(journalMagic), header[:min(n, len(journalMagic))]) {
+		// Empty, or cut short while it was created
+		return 0, nil
+	}
+	if string(header[:len(journalMagic)]) != journalMagic {
+		return 0, fmt.Errorf("%w: Not a journal", ErrCorruptJournal)
+	}
+	if version := binary.BigEndian.Uint16(header[len(journalMagic):]); version != journalVersion {
+		return 0, errors.New(fmt.Sprintf(
+			"Unsupported journal version %d", version))
+	}
+	for {
+		start := r.n
+		op, name, data, err := readEntry(r, info.Size())
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// No more entries, or the last one was never finished
+			return start, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v at offset %d", ErrCorruptJournal, err, start)
+		}
+		if apply != nil {
+			if err := apply(op, name, data); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// writeEntry writes a journal entry, which is:
+//
+//	op      byte (opWrite or opDelete)
+//	nameLen uint16
+//	dataLen uint64
+//	lenSum  CRC-32 (IEEE) of the fields above
+//	name    nameLen bytes
+//	sum     SHA-256 of name and data
+//	data    dataLen bytes (none for deletions)
+//
+// lenSum lets a damaged length be told apart from an entry cut short.
+func writeEntry(w io.Writer, op byte, name string, data []byte) error {
+	if len(name) > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("Filename too long: %.32s...", name))
+	}
+	hdr := make([]byte, 0, entryHeaderSize+len(name)+sha256.Size)
+	hdr = append(hdr, op)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(name)))
+	hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(data)))
+	hdr = binary.BigEndian.AppendUint32(hdr, crc32.ChecksumIEEE(hdr))
+	hdr = append(hdr, name...)
+	hdr = append(hdr, entrySum(name, data)...)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// entryHeaderSize is the size of an entry's fields up to and including lenSum
+const entryHeaderSize = 1 + 2 + 8 + 4
+
+// entrySum returns the SHA-256 of an entry's name and data
+func entrySum(name string, data []byte) []byte {
+	h := sha256.New()
+	io.WriteString(h, name)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// readEntry reads an entry written by writeEntry from r, which is size bytes
+// long in all.  No entry at all returns io.EOF, and an entry cut short by the
+// end of the journal returns io.ErrUnexpectedEOF.  Any other damage is an
+// error.
+func readEntry(r *countingReader, size int64) (op byte, name string, data []byte, err error) {
+	var hdr [entryHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, "", nil, err
+	}
+	if crc32.ChecksumIEEE(hdr[:entryHeaderSize-4]) != binary.BigEndian.Uint32(hdr[entryHeaderSize-4:]) {
+		return 0, "", nil, errors.New("Entry header checksum mismatch")
+	}
+	op = hdr[0]
+	if op != opWrite && op != opDelete {
+		return 0, "", nil, errors.New(fmt.Sprintf("Unknown op %q", op))
+	}
+	nameLen := uint64(binary.BigEndian.Uint16(hdr[1:]))
+	dataLen := binary.BigEndian.Uint64(hdr[3:])
+	remaining := uint64(size - r.n)
+	if dataLen > remaining || nameLen+sha256.Size+dataLen > remaining {
+		// The lengths check out, so the entry runs past the end
+		return 0, "", nil, io.ErrUnexpectedEOF
+	}
+	rest := make([]byte, nameLen+sha256.Size+dataLen)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return 0, "", nil, unexpectedEOF(err)
+	}
+	name = string(rest[:nameLen])
+	sum := rest[nameLen : nameLen+sha256.Size]
+	data = rest[nameLen+sha256.Size:]
+	if !bytes.Equal(entrySum(name, data), sum) {
+		if r.n == size {
+			// The last entry may not have made it to disk whole
+			return 0, "", nil, io.ErrUnexpectedEOF
+		}
+		return 0, "", nil, errors.New(fmt.Sprintf(
+			"Checksum mismatch for \"%s\"", name))
+	}
+	return op, name, data, nil
+}
+
+// writeJournalHeader writes the header of a new journal to w and returns its
+// size
+func writeJournalHeader(w io.Writer) (int64, error) {
+	header := binary.BigEndian.AppendUint16([]byte(journalMagic), journalVersion)
+	n, err := w.Write(header)
+	return int64(n), err
+}
+
+// putFile writes data to store as the file name
+func putFile(store Store, name string, data []byte) error {
+	f, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+// Close closes the journal
+func (js *JournalStore) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.f.Close()
+}
+
+func (js *JournalStore) Stat(name string) (int64, error) {
+	return js.store.Stat(name)
+}
+
+func (js *JournalStore) Open(name string) (File, error) {
+	return js.store.Open(name)
+}
+
+func (js *JournalStore) Create(name string) (StagedFile, error) {
+	f, err := js.store.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &journalStagedFile{store: js, name: name, f: f}, nil
+}
+
+func (js *JournalStore) Delete(name string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, err := js.store.Stat(name); err != nil {
+		return err
+	}
+	if err := js.append(opDelete, name, nil); err != nil {
+		return err
+	}
+	return js.store.Delete(name)
+}
+
+// CanonicalName returns the canonical name of the wrapped store, if it has
+// one
+func (js *JournalStore) CanonicalName(name string) string {
+	if c, ok := js.store.(Canonicalizer); ok {
+		return c.CanonicalName(name)
+	}
+	return name
+}
+
+func (js *JournalStore) List() ([]string, error) {
+	return js.store.List()
+}
+
+// append appends an entry to the journal and syncs it.  mu must be held.
+func (js *JournalStore) append(op byte, name string, data []byte) error {
+	var buf bytes.Buffer
+	if err := writeEntry(&buf, op, name, data); err != nil {
+		return err
+	}
+	n, err := js.f.Write(buf.Bytes())
+	if err == nil {
+		err = js.f.Sync()
+	}
+	if err != nil {
+		// Don't leave part of an entry for the next one to follow
+		js.f.Truncate(js.size)
+		js.f.Seek(js.size, io.SeekStart)
+		return err
+	}
+	js.size += int64(n)
+	return nil
+}
+
+// maybeCompact compacts the journal if it has grown enough.  mu must be held.
+func (js *JournalStore) maybeCompact() {
+	if js.threshold <= 0 || js.size <= js.threshold || js.size <= 2*js.compacted {
+		return
+	}
+	if err := js.compact(); err != nil {
+		// Keep appending to the old journal, which is still whole
+		log.Println("Failed to compact journal:", err)
+	}
+}
+
+// Compact rewrites the journal to hold just the current files
+func (js *JournalStore) Compact() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.compact()
+}
+
+// compact writes the current files to a new journal that replaces the old
+// one.  mu must be held.
+func (js *JournalStore) compact() error {
+	names, err := js.store.List()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	f, err := os.CreateTemp(filepath.Dir(js.filename), filepath.Base(js.filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	size, err := writeJournalHeader(w)
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		var data []byte
+		data, err = readFile(js.store, name)
+		if err == nil {
+			err = writeEntry(w, opWrite, name, data)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), js.filename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	js.f.Close()
+	js.f = f
+	js.size = size
+	js.compacted = size
+	return nil
+}
+
+// readFile reads the whole of the file name in store
+func readFile(store Store, name string) ([]byte, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readAll(f)
+}
+
+// A journalStagedFile is a file being written to a JournalStore.  It keeps a
+// copy of the data for the journal.
+type journalStagedFile struct {
+	store *JournalStore
+	name  string
+	f     StagedFile
+	data  []byte
+}
+
+func (sf *journalStagedFile) Write(p []byte) (int, error) {
+	n, err := sf.f.Write(p)
+	sf.data = append(sf.data, p[:n]...)
+	return n, err
+}
+
+// Commit appends the file to the journal and then commits it to the store.
+// Should the store fail to commit it, the file still comes back when the
+// journal is replayed.
+func (sf *journalStagedFile) Commit() error {
+	js := sf.store
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if err := js.append(opWrite, sf.name, sf.data); err != nil {
+		sf.f.Abort()
+		return err
+	}
+	sf.data = nil
+	if err := sf.f.Commit(); err != nil {
+		return err
+	}
+	js.maybeCompact()
+	return nil
+}
+
+func (sf *journalStagedFile) Abort() error {
+	sf.data = nil
+	return sf.f.Abort()
+}
+
+// A countingReader counts the bytes read through it
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
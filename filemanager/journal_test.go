@@ -0,0 +1,176 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openJournal opens the journal filename over a new MemStore
+func openJournal(t *testing.T, filename string, threshold int64) (*JournalStore, *MemStore) {
+	ms := NewMemStore()
+	js, err := NewJournalStore(filename, ms, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js, ms
+}
+
+func TestJournalStore(t *testing.T) {
+	js, _ := openJournal(t, filepath.Join(t.TempDir(), "journal"), 0)
+	defer js.Close()
+	testStore(t, js)
+}
+
+func TestJournalReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "journal")
+	js, _ := openJournal(t, filename, 0)
+	tfm, err := NewWithStore(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfm.SetOverwritePolicy(Overwrite)
+	tfm.AddFile("foo", []byte("abc"))
+	tfm.AddFile("bar", []byte("defg"))
+	tfm.AddFile("foo", []byte("hi"))
+	tfm.AddFile("baz", []byte{})
+	tfm.Delete("bar")
+	// Aborted writes aren't journaled
+	f, _ := js.Create("aborted")
+	f.Write([]byte("xyz"))
+	f.Abort()
+	js.Close()
+	want := map[string][]byte{"foo": []byte("hi"), "baz": []byte{}}
+
+	js, ms := openJournal(t, filename, 0)
+	if !reflect.DeepEqual(ms.files, want) {
+		t.Errorf("files: %q, want: %q", ms.files, want)
+	}
+	tfm, err = NewWithStore(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfm.used != 2 {
+		t.Errorf("used: %d, want: 2", tfm.used)
+	}
+	js.Close()
+}
+
+func TestJournalDamage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "journal")
+	js, _ := openJournal(t, filename, 0)
+	tfm, _ := NewWithStore(js)
+	tfm.AddFile("foo", []byte("abc"))
+	tfm.AddFile("bar", []byte("defg"))
+	js.Close()
+	journal, err := os.ReadFile(filename)
+	// The first entry's lengths follow the journal header and its op
+	nameLenOff := len(journalMagic) + 2 + 1
+	dataLenOff := nameLenOff + 2
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while appending "bar" loses just "bar"
+	for _, tail := range [][]byte{
+		journal[:len(journal)-1],
+		bytes.Replace(journal, []byte("defg"), []byte("\x00\x00\x00\x00"), 1)} {
+		os.WriteFile(filename, tail, 0600)
+		js, ms := openJournal(t, filename, 0)
+		want := map[string][]byte{"foo": []byte("abc")}
+		if !reflect.DeepEqual(ms.files, want) {
+			t.Errorf("files: %q, want: %q", ms.files, want)
+		}
+		// The next entry replaces the unfinished one
+		tfm, _ := NewWithStore(js)
+		tfm.AddFile("baz", []byte("hi"))
+		js.Close()
+		js, ms = openJournal(t, filename, 0)
+		want["baz"] = []byte("hi")
+		if !reflect.DeepEqual(ms.files, want) {
+			t.Errorf("files: %q, want: %q", ms.files, want)
+		}
+		js.Close()
+	}
+
+	// A crash while creating the journal loses nothing at all
+	for n := 0; n < len(journalMagic)+2; n++ {
+		os.WriteFile(filename, journal[:n], 0600)
+		js, ms := openJournal(t, filename, 0)
+		if len(ms.files) != 0 {
+			t.Errorf("%d byte header: files: %q, want none", n, ms.files)
+		}
+		tfm, _ := NewWithStore(js)
+		tfm.AddFile("baz", []byte("hi"))
+		js.Close()
+		js, ms = openJournal(t, filename, 0)
+		want := map[string][]byte{"baz": []byte("hi")}
+		if !reflect.DeepEqual(ms.files, want) {
+			t.Errorf("%d byte header: files: %q, want: %q", n, ms.files, want)
+		}
+		js.Close()
+	}
+
+	// Damage before the end is refused, even damage to a length that
+	// makes an entry look like it runs past the end
+	for _, damaged := range [][]byte{
+		bytes.Replace(journal, []byte("abc"), []byte("abd"), 1),
+		flipByte(journal, nameLenOff+1),
+		flipByte(journal, dataLenOff),
+		flipByte(journal, dataLenOff+7),
+		append([]byte("X"), journal[1:]...)} {
+		os.WriteFile(filename, damaged, 0600)
+		_, err := NewJournalStore(filename, NewMemStore(), 0)
+		if !errors.Is(err, ErrCorruptJournal) {
+			t.Errorf("err: %v, want: %v", err, ErrCorruptJournal)
+		}
+		data, _ := os.ReadFile(filename)
+		if !bytes.Equal(data, damaged) {
+			t.Error("Expected damaged journal to be left alone")
+		}
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "journal")
+	js, _ := openJournal(t, filename, 200)
+	tfm, _ := NewWithStore(js)
+	tfm.SetOverwritePolicy(Overwrite)
+	data := bytes.Repeat([]byte("x"), 50)
+	for i := 0; i < 100; i++ {
+		data[0] = byte(i)
+		if err := tfm.AddFile("foo", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tfm.AddFile("bar", []byte("abc"))
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 400 {
+		t.Errorf("Journal size: %d, want: <= 400", info.Size())
+	}
+	js.Close()
+	entries, _ := os.ReadDir(filepath.Dir(filename))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the journal, got %d files", len(entries))
+	}
+
+	js, ms := openJournal(t, filename, 200)
+	defer js.Close()
+	want := map[string][]byte{"foo": data, "bar": []byte("abc")}
+	if !reflect.DeepEqual(ms.files, want) {
+		t.Errorf("files: %q, want: %q", ms.files, want)
+	}
+}
+
+// flipByte returns a copy of data with the bits of byte i flipped
+func flipByte(data []byte, i int) []byte {
+	data = append([]byte{}, data...)
+	data[i] ^= 0xff
+	return data
+}
@@ -0,0 +1,117 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A MemStore is a Store that keeps its files in memory (though nothing
+// prevents the OS from swapping them to disk).
+type MemStore struct {
+	files map[string][]byte
+	mu    sync.Mutex
+}
+
+// NewMemStore returns a new, empty MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{files: make(map[string][]byte)}
+}
+
+func notExist(name string) error {
+	return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+}
+
+func (ms *MemStore) Stat(name string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, ok := ms.files[name]
+	if !ok {
+		return 0, notExist(name)
+	}
+	return int64(len(data)), nil
+}
+
+// Open returns a reader of the file's current data.  The data is never
+// modified in place (Commit swaps in new data), so readers keep the old data
+// if the file is replaced.
+func (ms *MemStore) Open(name string) (File, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, ok := ms.files[name]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return memFile{bytes.NewReader(data)}, nil
+}
+
+func (ms *MemStore) Create(name string) (StagedFile, error) {
+	return &memStagedFile{store: ms, name: name}, nil
+}
+
+func (ms *MemStore) Delete(name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.files[name]; !ok {
+		return notExist(name)
+	}
+	delete(ms.files, name)
+	return nil
+}
+
+func (ms *MemStore) List() ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	names := make([]string, 0, len(ms.files))
+	for name := range ms.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// A memFile is a file opened from a MemStore
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+// A memStagedFile buffers a file being written to a MemStore
+type memStagedFile struct {
+	store *MemStore
+	name  string
+	data  []byte
+	done  bool
+}
+
+func (f *memStagedFile) Write(p []byte) (int, error) {
+	if f.done {
+		return 0, errors.New("Write to finished file")
+	}
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *memStagedFile) Commit() error {
+	if f.done {
+		return errors.New("Commit of finished file")
+	}
+	f.done = true
+	if f.data == nil {
+		f.data = []byte{}
+	}
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+	f.store.files[f.name] = f.data
+	return nil
+}
+
+func (f *memStagedFile) Abort() error {
+	f.done = true
+	f.data = nil
+	return nil
+}
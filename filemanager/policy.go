@@ -0,0 +1,232 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+// An OverwritePolicy decides what happens when a client writes a file that
+// already exists.
+type OverwritePolicy int
+
+const (
+	// Reject refuses the write with ErrFileExists
+	Reject OverwritePolicy = iota
+	// Overwrite replaces the file once the upload is complete
+	Overwrite
+	// KeepVersioned replaces the file once the upload is complete, keeping
+	// the old one as "name.~N~" (like GNU cp's numbered backups).
+	KeepVersioned
+)
+
+var policyNames = map[OverwritePolicy]string{
+	Reject:        "reject",
+	Overwrite:     "overwrite",
+	KeepVersioned: "keep-versioned"}
+
+func (p OverwritePolicy) String() string {
+	name, ok := policyNames[p]
+	if !ok {
+		return fmt.Sprintf("OverwritePolicy(%d)", int(p))
+	}
+	return name
+}
+
+// ParseOverwritePolicy returns the policy named name: "reject", "overwrite",
+// or "keep-versioned".
+func ParseOverwritePolicy(name string) (OverwritePolicy, error) {
+	for p, pName := range policyNames {
+		if pName == name {
+			return p, nil
+		}
+	}
+	return Reject, errors.New(fmt.Sprintf(
+		"Unknown overwrite policy: %s", name))
+}
+
+// A WriteConflictPolicy decides what happens when a client writes a file that
+// another client is already writing.
+type WriteConflictPolicy int
+
+const (
+	// RejectConflict refuses the write with ErrFileExists
+	RejectConflict WriteConflictPolicy = iota
+	// QueueConflict makes the write wait for the other one to end, for up
+	// to the transfer's timeout.  The overwrite policy then applies as
+	// usual.
+	QueueConflict
+)
+
+var conflictPolicyNames = map[WriteConflictPolicy]string{
+	RejectConflict: "reject",
+	QueueConflict:  "queue"}
+
+func (p WriteConflictPolicy) String() string {
+	name, ok := conflictPolicyNames[p]
+	if !ok {
+		return fmt.Sprintf("WriteConflictPolicy(%d)", int(p))
+	}
+	return name
+}
+
+// ParseWriteConflictPolicy returns the policy named name: "reject" or "queue".
+func ParseWriteConflictPolicy(name string) (WriteConflictPolicy, error) {
+	for p, pName := range conflictPolicyNames {
+		if pName == name {
+			return p, nil
+		}
+	}
+	return RejectConflict, errors.New(fmt.Sprintf(
+		"Unknown write conflict policy: %s", name))
+}
+
+// SetWriteConflictPolicy sets the policy for writes of a file that is already
+// being written.  The default is RejectConflict.
+func (fm *FileManager) SetWriteConflictPolicy(policy WriteConflictPolicy) {
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	fm.conflictPolicy = policy
+}
+
+// SetOverwritePolicy sets the policy for files that no prefix policy covers.
+// The default is Reject.
+func (fm *FileManager) SetOverwritePolicy(policy OverwritePolicy) {
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	fm.policy = policy
+}
+
+// SetPrefixOverwritePolicy sets the policy for filenames starting with prefix.
+// When several prefixes match a filename, the longest one wins.
+func (fm *FileManager) SetPrefixOverwritePolicy(prefix string, policy OverwritePolicy) {
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	if fm.prefixPolicies == nil {
+		fm.prefixPolicies = make(map[string]OverwritePolicy)
+	}
+	fm.prefixPolicies[prefix] = policy
+}
+
+// CanWrite returns whether a client may write filename, which it can if the
+// file isn't read-only and either doesn't exist yet or the overwrite policy
+// allows replacing it.
+func (fm *FileManager) CanWrite(filename string) bool {
+	return fm.CheckWrite(filename) == nil
+}
+
+// CheckWrite is like CanWrite, but returns the error to send the client if it
+// can't write filename
+func (fm *FileManager) CheckWrite(filename string) error {
+	filename = fm.canonicalName(filename)
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	return fm.checkWrite(filename)
+}
+
+// checkWrite is CheckWrite with fileMu held
+func (fm *FileManager) checkWrite(filename string) error {
+	if fm.readOnly[filename] {
+		return &errs.SrvError{Code: defs.ErrAccessViolation,
+			Msg: fmt.Sprintf("Filename \"%s\" is read-only", filename)}
+	}
+	if fm.FileExists(filename) && fm.overwritePolicy(filename) == Reject {
+		return &errs.SrvError{Code: defs.ErrFileExists,
+			Msg: fmt.Sprintf("Filename \"%s\" already exists", filename)}
+	}
+	return nil
+}
+
+// MarkReadOnly stops clients from writing filename, whether or not it exists
+func (fm *FileManager) MarkReadOnly(filename string) {
+	filename = fm.canonicalName(filename)
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	fm.readOnly[filename] = true
+}
+
+// overwritePolicy returns the policy for filename.  fileMu must be held.
+func (fm *FileManager) overwritePolicy(filename string) OverwritePolicy {
+	policy, longest := fm.policy, -1
+	for prefix, p := range fm.prefixPolicies {
+		if strings.HasPrefix(filename, prefix) && len(prefix) > longest {
+			policy, longest = p, len(prefix)
+		}
+	}
+	return policy
+}
+
+// versionedName returns the first unused "filename.~N~".  fileMu must be held.
+func (fm *FileManager) versionedName(filename string) string {
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s.~%d~", filename, n)
+		if !fm.FileExists(name) {
+			return name
+		}
+	}
+}
+
+// An upload is a reservation of a filename for a write
+type upload struct {
+	// done is closed when the reservation is released
+	done chan struct{}
+	// remoteAddr is the address of the client writing the file
+	remoteAddr *net.UDPAddr
+}
+
+// reserveFilename reserves filename for a write by remoteAddr, which fails if
+// the file can't be written or another write of it is in progress.  If the
+// conflict policy says to queue, it waits up to timeout for the other write to
+// end instead.  A write by the same client is the same write, requested again
+// because the client hasn't heard back yet, so ErrPacketIgnored is returned
+// and the transfer already under way answers it.
+func (fm *FileManager) reserveFilename(filename string, remoteAddr *net.UDPAddr, timeout time.Duration) (*upload, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	for {
+		other, busy := fm.uploads[filename]
+		if !busy {
+			break
+		}
+		if sameAddr(other.remoteAddr, remoteAddr) {
+			return nil, errs.ErrPacketIgnored
+		}
+		if fm.conflictPolicy != QueueConflict {
+			return nil, &errs.SrvError{Code: defs.ErrFileExists,
+				Msg: fmt.Sprintf("Filename \"%s\" is already being written", filename)}
+		}
+		fm.fileMu.Unlock()
+		select {
+		case <-other.done:
+			fm.fileMu.Lock()
+		case <-timer.C:
+			fm.fileMu.Lock()
+			return nil, &errs.SrvError{Code: defs.ErrFileExists,
+				Msg: fmt.Sprintf("Filename \"%s\" is still being written", filename)}
+		}
+	}
+	// The file may have been written while we waited
+	if err := fm.checkWrite(filename); err != nil {
+		return nil, err
+	}
+	u := &upload{done: make(chan struct{}), remoteAddr: remoteAddr}
+	fm.uploads[filename] = u
+	return u, nil
+}
+
+// releaseFilename releases a reservation made by reserveFilename, letting any
+// queued writes proceed.  fileMu must be held.
+func (fm *FileManager) releaseFilename(filename string, u *upload) {
+	if u == nil || fm.uploads[filename] != u {
+		return
+	}
+	delete(fm.uploads, filename)
+	close(u.done)
+}
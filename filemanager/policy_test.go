@@ -0,0 +1,262 @@
+package filemanager
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+func TestParseOverwritePolicy(t *testing.T) {
+	for _, policy := range []OverwritePolicy{Reject, Overwrite, KeepVersioned} {
+		parsed, err := ParseOverwritePolicy(policy.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != policy {
+			t.Errorf("policy: %s, want: %s", parsed, policy)
+		}
+	}
+	_, err := ParseOverwritePolicy("clobber")
+	if err == nil {
+		t.Error("Expected error parsing unknown policy")
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	localTid := 1234
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	opts := TransferOpts{BlockSize: 8}
+	tfm := NewWithExistingFiles(
+		map[string][]byte{filename: []byte("abcdefghij")})
+	// Both files are held until the upload is complete
+	tfm.SetCapacity(16)
+	tfm.SetOverwritePolicy(Overwrite)
+	if !tfm.CanWrite(filename) {
+		t.Fatalf("Expected to be able to write \"%s\"", filename)
+	}
+
+	// Start reading the old file...
+	err := tfm.AddConnInfo(localTid, remoteTid, filename, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tfm.Read(localTid, remoteTid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ...while it's overwritten
+	writeTid := localTid + 1
+	err = tfm.AddConnInfo(writeTid, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = tfm.Write(writeTid, remoteTid, 1, []byte("zyxwvu"))
+	if err != errs.ErrTransferDone {
+		t.Fatal(err)
+	}
+	if string(memFiles(tfm)[filename]) != "zyxwvu" {
+		t.Errorf("File contains %q, want: %q", memFiles(tfm)[filename], "zyxwvu")
+	}
+	// The old file's space is freed
+	if tfm.used != 6 || tfm.reserved != 0 {
+		t.Errorf("used: %d, reserved: %d, want: 6, 0", tfm.used, tfm.reserved)
+	}
+
+	// The reader still gets the old file
+	blocks, err := tfm.Read(localTid, remoteTid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || string(blocks[0].Data) != "ij" {
+		t.Errorf("read: %v, want: %q", blocks, "ij")
+	}
+}
+
+func TestOverwriteAfterOpenRead(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	filename := "foo"
+	tfm := NewWithExistingFiles(map[string][]byte{filename: []byte("abc")})
+	tfm.SetOverwritePolicy(Overwrite)
+	err := tfm.AddConnInfo(1234, remoteTid, filename, 0, TransferOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The size is announced before the first read...
+	size, err := tfm.OpenRead(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 3 {
+		t.Errorf("size: %d, want: 3", size)
+	}
+	// ...so an overwrite in between doesn't change what's read
+	if err := tfm.AddFile(filename, []byte("zyxwvu")); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := tfm.Read(1234, remoteTid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || string(blocks[0].Data) != "abc" {
+		t.Errorf("read: %v, want: %q", blocks, "abc")
+	}
+}
+
+func TestKeepVersioned(t *testing.T) {
+	filename := "foo"
+	tfm := NewWithExistingFiles(map[string][]byte{filename: []byte("v1")})
+	tfm.SetOverwritePolicy(KeepVersioned)
+	for _, data := range []string{"v2", "v3"} {
+		err := tfm.AddFile(filename, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]string{
+		filename:  "v3",
+		"foo.~1~": "v1",
+		"foo.~2~": "v2"}
+	for name, data := range expected {
+		if string(memFiles(tfm)[name]) != data {
+			t.Errorf("%s contains %q, want: %q", name, memFiles(tfm)[name], data)
+		}
+	}
+	if tfm.used != 6 {
+		t.Errorf("used: %d, want: 6", tfm.used)
+	}
+}
+
+func TestPrefixOverwritePolicy(t *testing.T) {
+	tfm := NewWithExistingFiles(map[string][]byte{
+		"firmware/a.bin":     []byte("a"),
+		"firmware/old/b.bin": []byte("b"),
+		"config":             []byte("c")})
+	tfm.SetPrefixOverwritePolicy("firmware/", Overwrite)
+	tfm.SetPrefixOverwritePolicy("firmware/old/", Reject)
+	tests := []struct {
+		filename string
+		canWrite bool
+	}{
+		{"firmware/a.bin", true},
+		// The longest prefix wins
+		{"firmware/old/b.bin", false},
+		// The server-wide policy covers the rest
+		{"config", false},
+		{"new", true},
+	}
+	for _, test := range tests {
+		if tfm.CanWrite(test.filename) != test.canWrite {
+			t.Errorf("CanWrite(%q): %t, want: %t",
+				test.filename, !test.canWrite, test.canWrite)
+		}
+	}
+	err := tfm.AddFile("config", []byte("d"))
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFileExists {
+		t.Errorf("Got err: %#v, want ErrFileExists", err)
+	}
+}
+
+func TestWriteConflictReject(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	otherTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5679}
+	filename := "foo"
+	opts := TransferOpts{IsWrite: true}
+	tfm := New()
+	err := tfm.AddConnInfo(1234, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.AddConnInfo(1235, otherTid, filename, 1, opts)
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFileExists {
+		t.Fatalf("Got err: %#v, want ErrFileExists", err)
+	}
+	// Aborting the first write releases the filename
+	tfm.DelConnInfo(1234)
+	err = tfm.AddConnInfo(1235, otherTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteConflictQueue(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	otherTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5679}
+	filename := "foo"
+	opts := TransferOpts{IsWrite: true, Timeout: time.Second}
+	tfm := New()
+	tfm.SetWriteConflictPolicy(QueueConflict)
+	tfm.SetOverwritePolicy(Overwrite)
+	err := tfm.AddConnInfo(1234, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- tfm.AddConnInfo(1235, otherTid, filename, 1, opts)
+	}()
+	select {
+	case err = <-errCh:
+		t.Fatalf("Expected second write to wait, got err: %#v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, _, err = tfm.Write(1234, remoteTid, 1, []byte("abc"))
+	if err != errs.ErrTransferDone {
+		t.Fatal(err)
+	}
+	// The second write goes ahead once the first is done
+	err = <-errCh
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = tfm.Write(1235, otherTid, 1, []byte("def"))
+	if err != errs.ErrTransferDone {
+		t.Fatal(err)
+	}
+	if string(memFiles(tfm)[filename]) != "def" {
+		t.Errorf("File contains %q, want: %q", memFiles(tfm)[filename], "def")
+	}
+}
+
+func TestWriteConflictQueueTimeout(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	otherTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5679}
+	filename := "foo"
+	opts := TransferOpts{IsWrite: true, Timeout: 50 * time.Millisecond}
+	tfm := New()
+	tfm.SetWriteConflictPolicy(QueueConflict)
+	err := tfm.AddConnInfo(1234, remoteTid, filename, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tfm.AddConnInfo(1235, otherTid, filename, 1, opts)
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFileExists {
+		t.Fatalf("Got err: %#v, want ErrFileExists", err)
+	}
+}
+
+func TestWriteConflictRetransmit(t *testing.T) {
+	remoteTid := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	for _, policy := range []WriteConflictPolicy{RejectConflict, QueueConflict} {
+		tfm := New()
+		tfm.SetWriteConflictPolicy(policy)
+		opts := TransferOpts{IsWrite: true, Timeout: time.Second}
+		err := tfm.AddConnInfo(1234, remoteTid, "foo", 1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client resending its request is ignored rather than
+		// refused or queued
+		err = tfm.AddConnInfo(1235, remoteTid, "foo", 1, opts)
+		if err != errs.ErrPacketIgnored {
+			t.Errorf("%s: err: %v, want: %v", policy, err, errs.ErrPacketIgnored)
+		}
+		if _, _, err := tfm.Write(1234, remoteTid, 1, []byte("abc")); err != errs.ErrTransferDone {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package filemanager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Preload adds the files in a directory, a tar archive (.tar, .tar.gz or
+// .tgz), or a zip archive (.zip), and returns how many there were.  Files in
+// subdirectories are named by their slash-separated paths.  Preloaded files
+// replace any existing files of the same names regardless of the overwrite
+// policy, and if readOnly is set, clients can't replace them (see
+// MarkReadOnly).  Nothing is added unless all of the files can be read.
+func (fm *FileManager) Preload(name string, readOnly bool) (int, error) {
+	var files map[string][]byte
+	info, err := os.Stat(name)
+	lower := strings.ToLower(name)
+	switch {
+	case err != nil:
+		return 0, err
+	case info.IsDir():
+		files, err = readDir(name)
+	case strings.HasSuffix(lower, ".tar"):
+		files, err = readTar(name, false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		files, err = readTar(name, true)
+	case strings.HasSuffix(lower, ".zip"):
+		files, err = readZip(name)
+	default:
+		return 0, errors.New(fmt.Sprintf(
+			"Can't preload %s: not a directory, tar, or zip", name))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(files), fm.putAll(files, readOnly)
+}
+
+// archiveName returns the filename for a path in an archive, or "" if there
+// is none (e.g., "./" is stripped and ".." can't go above the top)
+func archiveName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// readDir reads the regular files under dir, following symlinks
+func readDir(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	return files, err
+}
+
+// readTar reads the regular files in a tar archive, which is gzipped if gz is
+// set
+func readTar(name string, gz bool) (map[string][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if gz {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		filename := archiveName(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || filename == "" {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[filename] = data
+	}
+}
+
+// readZip reads the files in a zip archive
+func readZip(name string) (map[string][]byte, error) {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	files := make(map[string][]byte)
+	for _, zf := range zr.File {
+		filename := archiveName(zf.Name)
+		if !zf.Mode().IsRegular() || filename == "" {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[filename] = data
+	}
+	return files, nil
+}
@@ -0,0 +1,138 @@
+package filemanager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+var preloadFiles = map[string][]byte{
+	"pxelinux.0":           []byte("boot"),
+	"pxelinux.cfg/default": []byte("menu"),
+	"empty":                []byte{}}
+
+// writeTar writes preloadFiles to a tar archive, plus a directory entry and a
+// path that tries to leave the archive
+func writeTar(t *testing.T, w io.Writer) {
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "pxelinux.cfg/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, data := range preloadFiles {
+		if name == "empty" {
+			name = "../empty"
+		}
+		tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg,
+			Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	for name, data := range preloadFiles {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, _ := os.Create(filepath.Join(tmp, "files.tar"))
+	writeTar(t, f)
+	f.Close()
+
+	f, _ = os.Create(filepath.Join(tmp, "files.tar.gz"))
+	zw := gzip.NewWriter(f)
+	writeTar(t, zw)
+	zw.Close()
+	f.Close()
+
+	f, _ = os.Create(filepath.Join(tmp, "files.zip"))
+	w := zip.NewWriter(f)
+	w.Create("pxelinux.cfg/")
+	for name, data := range preloadFiles {
+		fw, _ := w.Create(name)
+		fw.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, name := range []string{"dir", "files.tar", "files.tar.gz", "files.zip"} {
+		tfm := New()
+		n, err := tfm.Preload(filepath.Join(tmp, name), false)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if n != len(preloadFiles) {
+			t.Errorf("%s: n: %d, want: %d", name, n, len(preloadFiles))
+		}
+		if !reflect.DeepEqual(memFiles(tfm), preloadFiles) {
+			t.Errorf("%s: files: %q, want: %q", name, memFiles(tfm), preloadFiles)
+		}
+		if tfm.used != 8 {
+			t.Errorf("%s: used: %d, want: 8", name, tfm.used)
+		}
+	}
+
+	if _, err := New().Preload(filepath.Join(tmp, "missing.zip"), false); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("err: %v, want: %v", err, os.ErrNotExist)
+	}
+	os.WriteFile(filepath.Join(tmp, "files.txt"), nil, 0644)
+	if _, err := New().Preload(filepath.Join(tmp, "files.txt"), false); err == nil {
+		t.Error("Expected error preloading unsupported file")
+	}
+
+	tfm := New()
+	tfm.SetCapacity(7)
+	if _, err := tfm.Preload(dir, false); err == nil {
+		t.Error("Expected error preloading more than the capacity")
+	}
+	if len(memFiles(tfm)) != 0 {
+		t.Errorf("Expected no files, got %d", len(memFiles(tfm)))
+	}
+}
+
+func TestPreloadReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "foo"), []byte("abc"), 0644)
+	tfm := New()
+	tfm.SetOverwritePolicy(Overwrite)
+	if _, err := tfm.Preload(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if tfm.CanWrite("foo") {
+		t.Error("Expected read-only file to not be writable")
+	}
+	err := tfm.CheckWrite("foo")
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrAccessViolation {
+		t.Errorf("err: %v, want code: %d", err, defs.ErrAccessViolation)
+	}
+	if err := tfm.AddFile("foo", []byte("def")); err == nil {
+		t.Error("Expected error replacing read-only file")
+	}
+	if data, _ := tfm.File("foo"); string(data) != "abc" {
+		t.Errorf("File contains %q, want: %q", data, "abc")
+	}
+
+	// Deleting the file lifts the mark
+	if err := tfm.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if !tfm.CanWrite("foo") {
+		t.Error("Expected deleted file to be writable")
+	}
+}
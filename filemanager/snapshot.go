@@ -0,0 +1,313 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+// A snapshot holds a copy of every file, so that a FileManager that keeps its
+// files in memory can be restored after a restart.  All integers are big
+// endian.  The format is:
+//
+//	magic   "TFTPDMEM"
+//	version uint16 (snapshotVersion)
+//	records (see writeRecord), ended by a record with an empty name
+//	sum     SHA-256 of everything before it
+const (
+	snapshotMagic   = "TFTPDMEM"
+	snapshotVersion = 1
+)
+
+// ErrCorruptSnapshot is returned (wrapped) when a snapshot can't be read
+// because its data is damaged or cut short
+var ErrCorruptSnapshot = errors.New("Corrupt snapshot")
+
+// errBadRecord is returned (wrapped) by readRecord for a record whose
+// checksum or length is wrong
+var errBadRecord = errors.New("Bad record")
+
+func corrupt(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorruptSnapshot, fmt.Sprintf(format, a...))
+}
+
+// writeRecord writes a file record, which is:
+//
+//	nameLen uint16
+//	name    nameLen bytes
+//	dataLen uint64
+//	sum     SHA-256 of data
+//	data    dataLen bytes
+func writeRecord(w io.Writer, name string, data []byte) error {
+	if len(name) > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("Filename too long: %.32s...", name))
+	}
+	sum := sha256.Sum256(data)
+	hdr := make([]byte, 0, 2+len(name)+8+len(sum))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(name)))
+	hdr = append(hdr, name...)
+	hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(data)))
+	hdr = append(hdr, sum[:]...)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readRecord reads a record written by writeRecord and verifies its checksum.
+// A record cut short returns io.ErrUnexpectedEOF, no record at all returns
+// io.EOF, and a damaged record returns errBadRecord.
+func readRecord(r io.Reader) (name string, data []byte, err error) {
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return "", nil, err
+	}
+	nameBuf := make([]byte, nameLen)
+	var dataLen uint64
+	var sum [sha256.Size]byte
+	_, err = io.ReadFull(r, nameBuf)
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &dataLen)
+	}
+	if err == nil {
+		_, err = io.ReadFull(r, sum[:])
+	}
+	if err == nil && dataLen > math.MaxInt64 {
+		err = fmt.Errorf("%w: impossible length %d for \"%s\"",
+			errBadRecord, dataLen, nameBuf)
+	}
+	if err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	// The buffer grows as the data arrives, so a damaged length can't
+	// allocate more than there is to read.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(dataLen)); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	data = buf.Bytes()
+	if data == nil {
+		data = []byte{}
+	}
+	if sha256.Sum256(data) != sum {
+		return "", nil, fmt.Errorf("%w: checksum mismatch for \"%s\"",
+			errBadRecord, nameBuf)
+	}
+	return string(nameBuf), data, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for reads that have
+// already started
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteSnapshot writes a snapshot of all of the files to w.  Writes in
+// progress aren't included.
+func (fm *FileManager) WriteSnapshot(w io.Writer) error {
+	sum := sha256.New()
+	hw := io.MultiWriter(w, sum)
+	if _, err := io.WriteString(hw, snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(hw, binary.BigEndian, uint16(snapshotVersion)); err != nil {
+		return err
+	}
+	for _, name := range fm.Filenames() {
+		f, err := fm.store.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := readAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeRecord(hw, name, data); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(hw, "", nil); err != nil {
+		return err
+	}
+	_, err := w.Write(sum.Sum(nil))
+	return err
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot and adds its files,
+// which replace any existing files of the same names regardless of the
+// overwrite policy.  The whole snapshot is verified first, so a damaged
+// snapshot (see ErrCorruptSnapshot) adds no files at all.
+func (fm *FileManager) ReadSnapshot(r io.Reader) error {
+	files, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	return fm.putAll(files, false)
+}
+
+// putAll stores files, replacing any existing files of the same names, and
+// marks them read-only if readOnly is set.  Nothing is stored unless they all
+// fit in the capacity.
+func (fm *FileManager) putAll(files map[string][]byte, readOnly bool) error {
+	canonical := make(map[string][]byte, len(files))
+	for name, data := range files {
+		canonical[fm.canonicalName(name)] = data
+	}
+	files = canonical
+	fm.fileMu.Lock()
+	defer fm.fileMu.Unlock()
+	size, freed := 0, 0
+	for name, data := range files {
+		size += len(data)
+		if oldSize, err := fm.store.Stat(name); err == nil {
+			freed += int(oldSize)
+		}
+	}
+	if fm.capacity > 0 && fm.used-freed+fm.reserved+size > fm.capacity {
+		return &errs.SrvError{Code: defs.ErrFull,
+			Msg: fmt.Sprintf("Not enough space for %d more bytes", size-freed)}
+	}
+	for name, data := range files {
+		if err := fm.put(name, data); err != nil {
+			return err
+		}
+		if readOnly {
+			fm.readOnly[name] = true
+		}
+	}
+	return nil
+}
+
+// put stores data as filename, replacing any existing file.  fileMu must be
+// held.
+func (fm *FileManager) put(filename string, data []byte) error {
+	oldSize, err := fm.store.Stat(filename)
+	if err != nil {
+		oldSize = 0
+	}
+	f, err := fm.store.Create(filename)
+	if err != nil {
+		return fileErr(filename, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Commit()
+	} else {
+		f.Abort()
+	}
+	if err != nil {
+		return fileErr(filename, err)
+	}
+	fm.used += len(data) - int(oldSize)
+	return nil
+}
+
+// readSnapshot reads and verifies a whole snapshot
+func readSnapshot(r io.Reader) (map[string][]byte, error) {
+	sum := sha256.New()
+	hr := io.TeeReader(r, sum)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(hr, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, corrupt("Not a snapshot")
+	}
+	var version uint16
+	if err := binary.Read(hr, binary.BigEndian, &version); err != nil {
+		return nil, corrupt("Not a snapshot")
+	}
+	if version != snapshotVersion {
+		return nil, errors.New(fmt.Sprintf(
+			"Unsupported snapshot version %d", version))
+	}
+	files := make(map[string][]byte)
+	for {
+		name, data, err := readRecord(hr)
+		if err != nil {
+			return nil, corrupt("%v", unexpectedEOF(err))
+		}
+		if name == "" {
+			break
+		}
+		if _, ok := files[name]; ok {
+			return nil, corrupt("Duplicate file \"%s\"", name)
+		}
+		files[name] = data
+	}
+	if err := checkSum(r, sum); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// checkSum reads the SHA-256 sum at the end of r and checks it against sum
+func checkSum(r io.Reader, sum hash.Hash) error {
+	want := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, want); err != nil {
+		return corrupt("%v", unexpectedEOF(err))
+	}
+	if !bytes.Equal(sum.Sum(nil), want) {
+		return corrupt("Checksum mismatch")
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return corrupt("Trailing data")
+	}
+	return nil
+}
+
+// SaveSnapshot writes a snapshot to the file filename.  The snapshot is
+// written to a temp file that is renamed over filename, so a crash while
+// saving leaves the previous snapshot intact.
+func (fm *FileManager) SaveSnapshot(filename string) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = fm.WriteSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// LoadSnapshot reads the snapshot in the file filename (see ReadSnapshot).
+// The error matches os.ErrNotExist if there is no such file.
+func (fm *FileManager) LoadSnapshot(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fm.ReadSnapshot(bufio.NewReader(f))
+}
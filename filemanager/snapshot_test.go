@@ -0,0 +1,97 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	files := map[string][]byte{
+		"pxelinux.0":  []byte("boot"),
+		"cfg/default": []byte("menu"),
+		"empty":       []byte{}}
+	tfm := NewWithExistingFiles(files)
+	var buf bytes.Buffer
+	if err := tfm.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	tfm = New()
+	tfm.AddFile("pxelinux.0", []byte("old"))
+	tfm.AddFile("other", []byte("kept"))
+	if err := tfm.ReadSnapshot(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	files["other"] = []byte("kept")
+	if !reflect.DeepEqual(memFiles(tfm), files) {
+		t.Errorf("files: %q, want: %q", memFiles(tfm), files)
+	}
+	if tfm.used != 12 {
+		t.Errorf("used: %d, want: 12", tfm.used)
+	}
+
+	// Damage anywhere is refused without loading anything
+	damaged := map[string][]byte{
+		"truncated": snapshot[:len(snapshot)-1],
+		"trailing":  append(append([]byte{}, snapshot...), 0),
+		"data":      bytes.Replace(snapshot, []byte("menu"), []byte("mEnu"), 1),
+		"name":      bytes.Replace(snapshot, []byte("empty"), []byte("Empty"), 1),
+		"magic":     append([]byte("X"), snapshot[1:]...),
+		"empty":     []byte{}}
+	for desc, data := range damaged {
+		tfm := New()
+		err := tfm.ReadSnapshot(bytes.NewReader(data))
+		if !errors.Is(err, ErrCorruptSnapshot) {
+			t.Errorf("%s: err: %v, want: %v", desc, err, ErrCorruptSnapshot)
+		}
+		if len(memFiles(tfm)) != 0 {
+			t.Errorf("%s: Expected no files, got %d", desc, len(memFiles(tfm)))
+		}
+	}
+
+	version := append([]byte{}, snapshot...)
+	version[len(snapshotMagic)+1] = 2
+	if err := New().ReadSnapshot(bytes.NewReader(version)); err == nil {
+		t.Error("Expected error reading snapshot version 2")
+	}
+
+	tfm = New()
+	tfm.SetCapacity(7)
+	if err := tfm.ReadSnapshot(bytes.NewReader(snapshot)); err == nil {
+		t.Error("Expected error reading snapshot bigger than the capacity")
+	}
+}
+
+func TestSaveSnapshot(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshot")
+	tfm := New()
+	if err := tfm.LoadSnapshot(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("err: %v, want: %v", err, os.ErrNotExist)
+	}
+	tfm.AddFile("foo", []byte("abc"))
+	if err := tfm.SaveSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+	tfm.AddFile("bar", []byte("defg"))
+	if err := tfm.SaveSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filename))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the snapshot, got %d files", len(entries))
+	}
+
+	tfm = New()
+	if err := tfm.LoadSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"foo": []byte("abc"), "bar": []byte("defg")}
+	if !reflect.DeepEqual(memFiles(tfm), want) {
+		t.Errorf("files: %q, want: %q", memFiles(tfm), want)
+	}
+}
@@ -0,0 +1,51 @@
+package filemanager
+
+import (
+	"io"
+)
+
+// A Store holds the files that a FileManager serves.  The FileManager keeps
+// the state of transfers itself, so a store only needs to deal with whole
+// files.  Implementations must be safe for concurrent use.  Errors for files
+// that don't exist should match os.ErrNotExist (see errors.Is).
+type Store interface {
+	// Stat returns the size of the named file
+	Stat(name string) (int64, error)
+	// Open returns the named file for reading.  The file reads the same
+	// bytes until it's closed, even if the file is replaced meanwhile.
+	Open(name string) (File, error)
+	// Create returns a staged file for writing the named file, which
+	// replaces any existing file only once it's committed.
+	Create(name string) (StagedFile, error)
+	// Delete removes the named file
+	Delete(name string) error
+	// List returns the names of all of the files
+	List() ([]string, error)
+}
+
+// A Canonicalizer is a Store that knows its files by more than one name, e.g.,
+// "foo" and "/foo".  The FileManager keys everything it keeps about files
+// (write reservations, read-only marks, and overwrite policies) by the
+// canonical name, so the other names can't get around any of it.
+type Canonicalizer interface {
+	// CanonicalName returns the canonical name of the named file
+	CanonicalName(name string) string
+}
+
+// A File is a file opened for reading from a Store
+type File interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the size of the file in bytes
+	Size() int64
+}
+
+// A StagedFile is a file being written to a Store.  Exactly one of Commit or
+// Abort must be called once the writing is done.
+type StagedFile interface {
+	io.Writer
+	// Commit makes the written data the named file's contents
+	Commit() error
+	// Abort discards the written data
+	Abort() error
+}
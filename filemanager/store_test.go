@@ -0,0 +1,101 @@
+package filemanager
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStore checks the behavior that every Store shares.  The store must be
+// empty.
+func testStore(t *testing.T, store Store) {
+	if _, err := store.Stat("foo"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat err: %v, want: %v", err, os.ErrNotExist)
+	}
+	if _, err := store.Open("foo"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open err: %v, want: %v", err, os.ErrNotExist)
+	}
+
+	// Nothing shows up until the staged file is committed
+	f, err := store.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"abc", "def"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Stat("foo"); err == nil {
+		t.Error("Expected no file before commit")
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.Stat("foo"); err != nil || size != 6 {
+		t.Errorf("size: %d (%v), want: 6", size, err)
+	}
+
+	// Open files keep their data when the file is replaced
+	r, err := store.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err = store.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("x"))
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	n, _ := r.ReadAt(buf, 2)
+	if r.Size() != 6 || string(buf[:n]) != "cdef" {
+		t.Errorf("Read %q of %d bytes, want: %q of 6", buf[:n], r.Size(), "cdef")
+	}
+
+	// Aborted files are discarded
+	f, err = store.Create("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("abc"))
+	if err := f.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("bar"); err == nil {
+		t.Error("Expected no file after abort")
+	}
+	// Empty files are files too
+	f, err = store.Create("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := store.List()
+	sort.Strings(names)
+	if err != nil || !reflect.DeepEqual(names, []string{"bar", "foo"}) {
+		t.Errorf("names: %v (%v), want: [bar foo]", names, err)
+	}
+	if err := store.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("foo"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Delete err: %v, want: %v", err, os.ErrNotExist)
+	}
+	names, err = store.List()
+	if err != nil || !reflect.DeepEqual(names, []string{"bar"}) {
+		t.Errorf("names: %v (%v), want: [bar]", names, err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
@@ -0,0 +1,470 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	"github.com/bgmerrell/tftpdmem/netascii"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+// TransferOpts holds the per-transfer settings negotiated with a client.  A
+// zero value for any setting means the TFTP default.
+type TransferOpts struct {
+	BlockSize int
+	// TransferSize is the file size announced by a writing client with
+	// the tsize option.  The space is reserved when the conn info is
+	// added.
+	TransferSize int
+	// Timeout is how long to wait for the client before giving up
+	Timeout time.Duration
+	// WindowSize is the number of blocks sent per ACK (see RFC 7440)
+	WindowSize int
+	// Rollover is the block number (0 or 1) that follows block 65535
+	Rollover int
+	// Netascii is whether the file is transferred in netascii mode
+	Netascii bool
+	// IsWrite is whether the client is writing the file, in which case
+	// the filename is reserved for it until the transfer ends.
+	IsWrite bool
+}
+
+// A Block is a block of file data along with its block number
+type Block struct {
+	Num  uint16
+	Data []byte
+}
+
+type connInfo struct {
+	filename   string
+	remoteAddr *net.UDPAddr
+	// upload is the filename reservation of a write
+	upload       *upload
+	nextBlockNum uint64
+	blockSize    int
+	reserved     int
+	windowSize   int
+	rollover     int
+	// Block numbers are logical (see blocknum.go).  For reads,
+	// windowBase is the first block of the window last sent and
+	// nextBlockNum is its last block, so ACKs for any of the blocks in
+	// between are expected.
+	windowBase uint64
+	// For writes, unacked counts the blocks received since the last ACK
+	// and resynced records that the client has been sent an ACK for the
+	// last block received in order after a gap.  dups counts the
+	// duplicate blocks received since then.
+	unacked  int
+	resynced bool
+	dups     int
+	// For writes, staged is the file being written to the store (from
+	// the first block on) and written counts the bytes written to it.
+	staged  StagedFile
+	written int
+	// progress is what DescribeTransfer reports: the bytes written so far
+	// for writes and nextBlockNum for reads.  It's atomic because
+	// transfers are described while they're running.
+	progress atomic.Uint64
+	// For reads, file is the file as opened by OpenRead (or the first
+	// read), so that the client gets the same bytes throughout even if
+	// the file is overwritten.
+	file File
+	// For netascii transfers, encoded holds the translated file for reads
+	// and decoder translates blocks for writes.
+	netascii bool
+	encoded  []byte
+	decoder  netascii.Decoder
+}
+
+// NewTid returns a new local TID, which identifies a transfer to the
+// FileManager.  The TIDs are unique among all of the servers that share the
+// FileManager, unlike ports, which transfers on different local addresses
+// (or sharing a port; see server.Config.SinglePort) may have in common.
+func (fm *FileManager) NewTid() int {
+	fm.connMu.Lock()
+	defer fm.connMu.Unlock()
+	fm.lastTid++
+	return fm.lastTid
+}
+
+// AddConnInfo adds connection info by TID pair.  The remote TID is the
+// client's full address, so packets from another host using the same port
+// aren't mistaken for the client's.
+func (fm *FileManager) AddConnInfo(localTid int, remoteAddr *net.UDPAddr, filename string, nextBlockNum uint16, opts TransferOpts) error {
+	filename = fm.canonicalName(filename)
+	// Reserving the filename may mean waiting for another write, so do
+	// it before taking any locks.
+	var upload *upload
+	if opts.IsWrite {
+		var err error
+		upload, err = fm.reserveFilename(filename, remoteAddr, opts.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	fm.connMu.Lock()
+	defer fm.connMu.Unlock()
+	_, ok := fm.tidToConnInfo[localTid]
+	if ok {
+		fm.fileMu.Lock()
+		fm.releaseFilename(filename, upload)
+		fm.fileMu.Unlock()
+		return errors.New(fmt.Sprintf(
+			"Local TID %d already exists", localTid))
+	}
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = defs.BlockSize
+	}
+	fm.fileMu.Lock()
+	err := fm.reserve(opts.TransferSize)
+	if err != nil {
+		fm.releaseFilename(filename, upload)
+	}
+	fm.fileMu.Unlock()
+	if err != nil {
+		return err
+	}
+	windowSize := opts.WindowSize
+	if windowSize == 0 {
+		windowSize = 1
+	}
+	info := &connInfo{
+		filename:     filename,
+		remoteAddr:   remoteAddr,
+		upload:       upload,
+		nextBlockNum: uint64(nextBlockNum),
+		blockSize:    blockSize,
+		reserved:     opts.TransferSize,
+		windowSize:   windowSize,
+		rollover:     opts.Rollover,
+		netascii:     opts.Netascii,
+		windowBase:   uint64(nextBlockNum)}
+	if !opts.IsWrite {
+		info.progress.Store(info.nextBlockNum)
+	}
+	fm.tidToConnInfo[localTid] = info
+	return nil
+}
+
+// DelConnInfo deletes connection info by TID pair, releasing any capacity and
+// filename reserved for it and discarding any data written.
+func (fm *FileManager) DelConnInfo(localTid int) {
+	fm.connMu.Lock()
+	defer fm.connMu.Unlock()
+	info, ok := fm.tidToConnInfo[localTid]
+	if !ok {
+		return
+	}
+	if info.staged != nil {
+		info.staged.Abort()
+	}
+	if info.file != nil {
+		info.file.Close()
+	}
+	fm.fileMu.Lock()
+	fm.reserved -= info.reserved
+	fm.releaseFilename(info.filename, info.upload)
+	fm.fileMu.Unlock()
+	delete(fm.tidToConnInfo, localTid)
+}
+
+// Abort ends a transfer on behalf of the client, discarding any data written
+// so far.
+func (fm *FileManager) Abort(localTid int, remoteAddr *net.UDPAddr) error {
+	fm.connMu.Lock()
+	info, ok := fm.tidToConnInfo[localTid]
+	fm.connMu.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf(
+			"No connection info for local TID (%d)", localTid))
+	}
+	if !sameAddr(remoteAddr, info.remoteAddr) {
+		return errs.UnexpectedRemoteTidErr{
+			Tid: remoteAddr.String(), ExpectedTid: info.remoteAddr.String()}
+	}
+	fm.DelConnInfo(localTid)
+	return nil
+}
+
+// DescribeTransfer returns a short description of the transfer with the local
+// TID for logging, or "" if there is none.
+func (fm *FileManager) DescribeTransfer(localTid int) string {
+	fm.connMu.Lock()
+	defer fm.connMu.Unlock()
+	info, ok := fm.tidToConnInfo[localTid]
+	if !ok {
+		return ""
+	}
+	if info.upload != nil {
+		return fmt.Sprintf("write of \"%s\" from %s (%d bytes received)",
+			info.filename, info.remoteAddr, info.progress.Load())
+	}
+	return fmt.Sprintf("read of \"%s\" by %s (at block %d)",
+		info.filename, info.remoteAddr, info.progress.Load())
+}
+
+// OpenRead opens the file of the read with the local TID, if it isn't open
+// already, and returns its size as it will be transferred.  The client gets
+// the file as it was when it was opened even if it's overwritten later, so
+// the size can be announced (see the tsize option) before the first read.
+func (fm *FileManager) OpenRead(localTid int) (int, error) {
+	fm.connMu.Lock()
+	info, ok := fm.tidToConnInfo[localTid]
+	fm.connMu.Unlock()
+	if !ok {
+		return 0, errors.New(fmt.Sprintf(
+			"No connection info for local TID (%d)", localTid))
+	}
+	if info.file == nil {
+		err := info.open(fm.store)
+		if err != nil {
+			fm.DelConnInfo(localTid)
+			return 0, fileErr(info.filename, err)
+		}
+	}
+	return info.size(), nil
+}
+
+// sameAddr returns whether a and b are the same UDP address
+func sameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
+// wireBlockNum returns the wire block number of logical block n
+func (info *connInfo) wireBlockNum(n uint64) uint16 {
+	return wireBlockNum(n, info.rollover)
+}
+
+// open opens the file of a read.  Netascii translation needs the whole file,
+// so a netascii file is translated up front.
+func (info *connInfo) open(store Store) error {
+	file, err := store.Open(info.filename)
+	if err != nil {
+		return err
+	}
+	info.file = file
+	if info.netascii {
+		data, err := readAll(file)
+		if err != nil {
+			return err
+		}
+		info.encoded = netascii.Encode(data)
+	}
+	return nil
+}
+
+// size returns the size of a read's file as it is transferred
+func (info *connInfo) size() int {
+	if info.netascii {
+		return len(info.encoded)
+	}
+	return int(info.file.Size())
+}
+
+// readBlock returns the bytes of a read's file from start to end
+func (info *connInfo) readBlock(start int, end int) ([]byte, error) {
+	if info.netascii {
+		return info.encoded[start:end], nil
+	}
+	data := make([]byte, end-start)
+	n, err := info.file.ReadAt(data, int64(start))
+	if n == len(data) {
+		return data, nil
+	}
+	return nil, err
+}
+
+// Write takes a tid and a blockNum and attempts to write data to a "file"
+// buffer.  It returns the block number to acknowledge and whether to send an
+// ACK at all, since a client using a window is only acknowledged at the end
+// of each window (or after a gap).  ErrTransferDone is returned with the final
+// ACK once the file has been added.  ErrPacketIgnored is returned for blocks
+// that are dropped without an ACK.
+func (fm *FileManager) Write(localTid int, remoteAddr *net.UDPAddr, blockNum uint16, buf []byte) (ackNum uint16, ack bool, err error) {
+	fm.connMu.Lock()
+	info, ok := fm.tidToConnInfo[localTid]
+	fm.connMu.Unlock()
+	if !ok {
+		return 0, false, errors.New(fmt.Sprintf(
+			"No connection info for local TID (%d)", localTid))
+	}
+	if !sameAddr(remoteAddr, info.remoteAddr) {
+		return 0, false, errs.UnexpectedRemoteTidErr{
+			Tid: remoteAddr.String(), ExpectedTid: info.remoteAddr.String()}
+	}
+	if err := fm.CheckWrite(info.filename); err != nil {
+		fm.DelConnInfo(localTid)
+		return 0, false, err
+	}
+	block, ok := logicalBlockNum(blockNum, info.nextBlockNum, info.rollover)
+	if !ok || block != info.nextBlockNum {
+		// A later block from the same window means some were lost,
+		// so ACK the last block received in order and the client will
+		// resend from there (see RFC 7440).  The rest of the window
+		// is ignored.
+		if ok && block > info.nextBlockNum &&
+			block-info.nextBlockNum < uint64(info.windowSize) {
+			if info.resynced {
+				return 0, false, errs.ErrPacketIgnored
+			}
+			info.resynced = true
+			info.unacked = 0
+			return info.wireBlockNum(info.nextBlockNum - 1), true, nil
+		}
+		// An earlier block from the last window means the client
+		// missed our ACK and is resending, so ACK again.  A client
+		// resending a whole window gets one ACK per window.
+		if ok && block < info.nextBlockNum &&
+			info.nextBlockNum-block <= uint64(info.windowSize) {
+			info.dups++
+			if (info.dups-1)%info.windowSize != 0 {
+				return 0, false, errs.ErrPacketIgnored
+			}
+			info.unacked = 0
+			return info.wireBlockNum(info.nextBlockNum - 1), true, nil
+		}
+		fm.DelConnInfo(localTid)
+		return 0, false, errors.New(fmt.Sprintf("Got block %d, want %d",
+			blockNum, info.wireBlockNum(info.nextBlockNum)))
+	}
+	info.resynced = false
+	info.dups = 0
+	// A short block is the last one
+	last := len(buf) < info.blockSize
+	if info.netascii {
+		buf = info.decoder.Decode(buf)
+		if last {
+			buf = append(buf, info.decoder.Flush()...)
+		}
+	}
+	// Grow the reservation if the client sends more than it announced
+	if extra := info.written + len(buf) - info.reserved; extra > 0 {
+		fm.fileMu.Lock()
+		err := fm.reserve(extra)
+		fm.fileMu.Unlock()
+		if err != nil {
+			fm.DelConnInfo(localTid)
+			return 0, false, err
+		}
+		info.reserved += extra
+	}
+	if info.staged == nil {
+		info.staged, err = fm.store.Create(info.filename)
+	}
+	if err == nil {
+		_, err = info.staged.Write(buf)
+	}
+	if err != nil {
+		fm.DelConnInfo(localTid)
+		return 0, false, fileErr(info.filename, err)
+	}
+	info.written += len(buf)
+	info.progress.Store(uint64(info.written))
+
+	// Not done yet...
+	if !last {
+		info.nextBlockNum++
+		info.unacked++
+		if info.unacked < info.windowSize {
+			return 0, false, nil
+		}
+		info.unacked = 0
+		return blockNum, true, nil
+	}
+
+	// Done
+	fm.fileMu.Lock()
+	err = fm.commit(info.filename, info.staged, info.written, info.reserved)
+	// The staged file is committed or aborted either way
+	info.staged = nil
+	if err == nil {
+		info.reserved = 0
+	}
+	fm.fileMu.Unlock()
+	fm.DelConnInfo(localTid)
+	if err != nil {
+		return 0, false, err
+	}
+	return blockNum, true, errs.ErrTransferDone
+}
+
+// Read takes a tid and the blockNum acknowledged by the client and returns the
+// next window of blocks from a "file" buffer, starting with block blockNum+1.
+// ErrTransferDone is returned once the final block has been acknowledged.
+// ErrPacketIgnored is returned for a duplicate ACK.
+func (fm *FileManager) Read(localTid int, remoteAddr *net.UDPAddr, blockNum uint16) ([]Block, error) {
+	fm.connMu.Lock()
+	info, ok := fm.tidToConnInfo[localTid]
+	fm.connMu.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(
+			"No connection info for local TID (%d)", localTid))
+	}
+	if !sameAddr(remoteAddr, info.remoteAddr) {
+		return nil, errs.UnexpectedRemoteTidErr{
+			Tid: remoteAddr.String(), ExpectedTid: info.remoteAddr.String()}
+	}
+	// An ACK from the middle of the window means the client missed the
+	// blocks after it, so the next window starts there.
+	block, ok := logicalBlockNum(blockNum, info.nextBlockNum, info.rollover)
+	// A duplicate of an ACK from before the window was sent must not be
+	// answered, or every block after it would be sent twice (the
+	// Sorcerer's Apprentice bug; see RFC 1123).  A lost window is
+	// resent on timeout instead.
+	if ok && block < info.windowBase &&
+		info.windowBase-block <= uint64(info.windowSize) {
+		return nil, errs.ErrPacketIgnored
+	}
+	if !ok || block < info.windowBase || block > info.nextBlockNum {
+		fm.DelConnInfo(localTid)
+		if info.windowBase == info.nextBlockNum {
+			return nil, errors.New(fmt.Sprintf("Got block %d, want %d",
+				blockNum, info.wireBlockNum(info.nextBlockNum)))
+		}
+		return nil, errors.New(fmt.Sprintf("Got block %d, want %d to %d",
+			blockNum, info.wireBlockNum(info.windowBase),
+			info.wireBlockNum(info.nextBlockNum)))
+	}
+	size, err := fm.OpenRead(localTid)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []Block
+	for i := 0; i < info.windowSize; i++ {
+		startIdx := (int(block) + i) * info.blockSize
+		endIdx := startIdx + info.blockSize
+		// A final ACK will put the startIdx out of bounds, and we
+		// don't need to respond to it.
+		if startIdx > size {
+			break
+		} else if endIdx > size {
+			endIdx = size
+		}
+		data, err := info.readBlock(startIdx, endIdx)
+		if err != nil {
+			fm.DelConnInfo(localTid)
+			return nil, fileErr(info.filename, err)
+		}
+		blocks = append(blocks, Block{
+			Num:  info.wireBlockNum(block + uint64(i) + 1),
+			Data: data})
+		// A short block is the last one
+		if endIdx-startIdx < info.blockSize {
+			break
+		}
+	}
+	if len(blocks) == 0 {
+		fm.DelConnInfo(localTid)
+		return nil, errs.ErrTransferDone
+	}
+	info.windowBase = block + 1
+	info.nextBlockNum = block + uint64(len(blocks))
+	info.progress.Store(info.nextBlockNum)
+
+	return blocks, nil
+}
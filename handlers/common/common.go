@@ -36,3 +36,25 @@ func BuildDataPacket(blockNum uint16, filedata []byte) ([]byte, error) {
 	}
 	return datapkt, err
 }
+
+// An Option is a TFTP option name/value pair (see RFC 2347)
+type Option struct {
+	Name  string
+	Value string
+}
+
+// BuildOackPacket builds and returns a TFTP OACK packet acknowledging opts
+func BuildOackPacket(opts []Option) ([]byte, error) {
+	data := []interface{}{uint16(defs.OpOack)}
+	for _, opt := range opts {
+		data = append(data,
+			[]byte(opt.Name), uint8(0), []byte(opt.Value), uint8(0))
+	}
+	oackpkt, err := util.BuildResponse(data)
+	if err != nil {
+		msg := "Error building oack response: " + err.Error()
+		log.Println(msg)
+		return nil, errors.New(msg)
+	}
+	return oackpkt, err
+}
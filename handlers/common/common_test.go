@@ -29,3 +29,18 @@ func TestBuildDataPacket(t *testing.T) {
 		t.Errorf("Got %#v, want %#v", datapkt, expected)
 	}
 }
+
+func TestBuildOackPacket(t *testing.T) {
+	opts := []Option{{"blksize", "1024"}, {"tsize", "3"}}
+	oackpkt, err := BuildOackPacket(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// \0\6blksize\01024\0tsize\03\0
+	expected := []byte{0x00, 0x06,
+		0x62, 0x6c, 0x6b, 0x73, 0x69, 0x7a, 0x65, 0x00, 0x31, 0x30, 0x32, 0x34, 0x00,
+		0x74, 0x73, 0x69, 0x7a, 0x65, 0x00, 0x33, 0x00}
+	if bytes.Compare(oackpkt, expected) != 0 {
+		t.Errorf("Got %#v, want %#v", oackpkt, expected)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"log"
 	"net"
 
-	fm "github.com/bgmerrell/tftpdmem/filemanager"
 	"github.com/bgmerrell/tftpdmem/handlers/common"
+	"github.com/bgmerrell/tftpdmem/server"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
 )
 
 // getBlockNum returns the block number from the raw buf assuming the op code
@@ -23,7 +25,7 @@ func getBlockNum(buf []byte) (uint16, error) {
 	return blockNum, err
 }
 
-func HandleWriteData(buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fm.FileManager) (resp []byte, err error) {
+func HandleWriteData(buf []byte, s *server.Server, src *net.UDPAddr) (resps [][]byte, err error) {
 	blockNum, err := getBlockNum(buf)
 	if err != nil {
 		return nil, err
@@ -32,41 +34,71 @@ func HandleWriteData(buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fm.Fil
 	const blockNumBoundary = 2 // Two bytes of block num
 	buf = buf[blockNumBoundary:]
 
-	localPort := conn.LocalAddr().(*net.UDPAddr).Port
-	err = fm.Write(localPort, src.Port, blockNum, buf)
-	if err != nil {
+	localTid := s.Tid()
+	ackNum, ack, err := s.FileManager().Write(localTid, src, blockNum, buf)
+	if err != nil && err != errs.ErrTransferDone {
 		return nil, err
 	}
-
-	resp, err = common.BuildAckPacket(blockNum)
-	if err != nil {
+	// No response in the middle of a window
+	if !ack {
 		return nil, err
 	}
 
-	return resp, err
+	resp, ackErr := common.BuildAckPacket(ackNum)
+	if ackErr != nil {
+		return nil, ackErr
+	}
+
+	return [][]byte{resp}, err
 }
 
-func HandleReadData(buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fm.FileManager) (resp []byte, err error) {
+func HandleReadData(buf []byte, s *server.Server, src *net.UDPAddr) (resps [][]byte, err error) {
 	blockNum, err := getBlockNum(buf)
 	if err != nil {
 		return nil, err
 	}
 
-	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	localTid := s.Tid()
 
-	data, err := fm.Read(localPort, src.Port, blockNum)
+	// No response for a terminal ACK, which ends the transfer
+	blocks, err := s.FileManager().Read(localTid, src, blockNum)
 	if err != nil {
 		return nil, err
 	}
-	// No response for a terminal ACK
-	if data == nil {
-		return nil, nil
+
+	for _, block := range blocks {
+		resp, err := common.BuildDataPacket(block.Num, block.Data)
+		if err != nil {
+			return nil, err
+		}
+		resps = append(resps, resp)
+	}
+
+	return resps, nil
+}
+
+// HandleError handles an ERROR packet from the client, which ends the transfer
+// immediately and discards any partial upload.  ERROR packets are never
+// answered (see RFC 1350).
+func HandleError(buf []byte, s *server.Server, src *net.UDPAddr) (resps [][]byte, err error) {
+	// The error code is laid out like a block number.  A malformed ERROR
+	// packet still ends the transfer.
+	code, _ := getBlockNum(buf)
+	msg := ""
+	if len(buf) > 2 {
+		msg = string(buf[2:])
+		if n := bytes.IndexByte(buf[2:], 0); n >= 0 {
+			msg = msg[:n]
+		}
 	}
 
-	resp, err = common.BuildDataPacket(blockNum+1, data)
+	localTid := s.Tid()
+	err = s.FileManager().Abort(localTid, src)
 	if err != nil {
-		return nil, err
+		// Only the client can abort its own transfer
+		log.Printf("Ignoring ERROR packet from %s: %s", src, err)
+		return nil, errs.ErrPacketIgnored
 	}
-
-	return resp, err
+	log.Printf("Transfer aborted by client %s: %s (%d)", src, msg, code)
+	return nil, errs.ErrTransferDone
 }
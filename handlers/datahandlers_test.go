@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	fmgr "github.com/bgmerrell/tftpdmem/filemanager"
+	"github.com/bgmerrell/tftpdmem/server"
 	errs "github.com/bgmerrell/tftpdmem/server/errors"
 )
 
@@ -44,19 +45,21 @@ func TestHandleWriteData(t *testing.T) {
 	}
 	defer conn.Close()
 	lAddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(lAddr.Port, conn, nil, true, fm, server.DefaultConfig())
 	rAddr := &net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: lAddr.Port - 1}
-	err = fm.AddConnInfo(lAddr.Port, rAddr.Port, filename, nextBlockNum)
+	err = fm.AddConnInfo(lAddr.Port, rAddr, filename, nextBlockNum, fmgr.TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := HandleWriteData(data, conn, rAddr, fm)
-	if err != nil {
+	resps, err := HandleWriteData(data, s, rAddr)
+	// A short block finishes the transfer
+	if err != errs.ErrTransferDone {
 		t.Error(err)
 	}
-	if bytes.Compare(resp, expectedResp) != 0 {
-		t.Errorf("resp: %#v, want %#v", resp, expectedResp)
+	if len(resps) != 1 || bytes.Compare(resps[0], expectedResp) != 0 {
+		t.Errorf("resp: %#v, want %#v", resps, expectedResp)
 	}
 }
 
@@ -73,14 +76,15 @@ func TestHandleWriteDataBadBlock(t *testing.T) {
 	}
 	defer conn.Close()
 	lAddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(lAddr.Port, conn, nil, true, fm, server.DefaultConfig())
 	rAddr := &net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: lAddr.Port - 1}
-	err = fm.AddConnInfo(lAddr.Port, rAddr.Port, filename, nextBlockNum)
+	err = fm.AddConnInfo(lAddr.Port, rAddr, filename, nextBlockNum, fmgr.TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = HandleWriteData(data, conn, rAddr, fm)
+	_, err = HandleWriteData(data, s, rAddr)
 	if err == nil {
 		t.Errorf("Expected error getting block for data: %#v", data)
 	}
@@ -99,12 +103,13 @@ func TestHandleWriteDataUnexpectedRemoteTid(t *testing.T) {
 	}
 	defer conn.Close()
 	lAddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(lAddr.Port, conn, nil, true, fm, server.DefaultConfig())
 	rAddr := &net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: lAddr.Port - 1}
 	fmt.Println("ltid:", lAddr.Port)
 	fmt.Println("rtid:", rAddr.Port)
-	err = fm.AddConnInfo(lAddr.Port, rAddr.Port, filename, nextBlockNum)
+	err = fm.AddConnInfo(lAddr.Port, rAddr, filename, nextBlockNum, fmgr.TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,7 +117,7 @@ func TestHandleWriteDataUnexpectedRemoteTid(t *testing.T) {
 	rAddr = &net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: lAddr.Port - 2}
-	_, err = HandleWriteData(data, conn, rAddr, fm)
+	_, err = HandleWriteData(data, s, rAddr)
 	if err == nil {
 		t.Error("Expected error writing data with incorrect remote TID")
 	}
@@ -137,27 +142,28 @@ func TestHandleReadData(t *testing.T) {
 	}
 	defer conn.Close()
 	lAddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(lAddr.Port, conn, nil, true, fm, server.DefaultConfig())
 	rAddr := &net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: lAddr.Port - 1}
-	err = fm.AddConnInfo(lAddr.Port, rAddr.Port, filename, nextBlockNum)
+	err = fm.AddConnInfo(lAddr.Port, rAddr, filename, nextBlockNum, fmgr.TransferOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := HandleReadData(data, conn, rAddr, fm)
+	resps, err := HandleReadData(data, s, rAddr)
 	if err != nil {
 		t.Error(err)
 	}
-	if bytes.Compare(resp, expectedResp) != 0 {
-		t.Errorf("resp: %#v, want %#v", resp, expectedResp)
+	if len(resps) != 1 || bytes.Compare(resps[0], expectedResp) != 0 {
+		t.Errorf("resp: %#v, want %#v", resps, expectedResp)
 	}
 	// Send the final ACK
 	data = []byte{0x00, 0x01}
-	resp, err = HandleReadData(data, conn, rAddr, fm)
-	if err != nil {
-		t.Error(err)
+	resps, err = HandleReadData(data, s, rAddr)
+	if err != errs.ErrTransferDone {
+		t.Errorf("err: %#v, want ErrTransferDone", err)
 	}
-	if resp != nil {
+	if resps != nil {
 		t.Error("Expected nil response for final ACK")
 	}
 }
@@ -175,11 +181,61 @@ func TestHandleReadDataNoConnInfo(t *testing.T) {
 	}
 	defer conn.Close()
 	lAddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(lAddr.Port, conn, nil, true, fm, server.DefaultConfig())
 	rAddr := &net.UDPAddr{
 		IP:   net.ParseIP(ip),
 		Port: lAddr.Port - 1}
-	_, err = HandleReadData(data, conn, rAddr, fm)
+	_, err = HandleReadData(data, s, rAddr)
 	if err == nil {
 		t.Error("Expected error due to no conn info")
 	}
 }
+
+func TestHandleError(t *testing.T) {
+	fm := fmgr.New()
+	filename := "foo"
+	ip := "127.0.0.1"
+	// Disk full, "oops"
+	data := []byte{0x00, 0x03, 0x6f, 0x6f, 0x70, 0x73, 0x00}
+	lAddr := &net.UDPAddr{IP: net.ParseIP(ip)}
+	conn, err := net.ListenUDP(lAddr.Network(), lAddr)
+	if err != nil {
+		t.Fatal("Error getting new UDP conn:", err)
+	}
+	defer conn.Close()
+	lAddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(lAddr.Port, conn, nil, true, fm, server.DefaultConfig())
+	rAddr := &net.UDPAddr{
+		IP:   net.ParseIP(ip),
+		Port: lAddr.Port - 1}
+	err = fm.AddConnInfo(lAddr.Port, rAddr, filename, 1, fmgr.TransferOpts{BlockSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = HandleWriteData([]byte{0x00, 0x01, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, s, rAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another host can't abort the transfer...
+	badAddr := &net.UDPAddr{
+		IP:   net.ParseIP(ip),
+		Port: lAddr.Port - 2}
+	resps, err := HandleError(data, s, badAddr)
+	if resps != nil || err != errs.ErrPacketIgnored {
+		t.Errorf("Got resps: %#v, err: %#v.  Want nil and ErrPacketIgnored", resps, err)
+	}
+	// ...but the client can, without a response
+	resps, err = HandleError(data, s, rAddr)
+	if resps != nil || err != errs.ErrTransferDone {
+		t.Errorf("Got resps: %#v, err: %#v.  Want nil and ErrTransferDone", resps, err)
+	}
+	// The partial upload is gone
+	if fm.FileExists(filename) {
+		t.Errorf("Expected filename \"%s\" to not exist", filename)
+	}
+	_, err = HandleWriteData([]byte{0x00, 0x02, 'i'}, s, rAddr)
+	if err == nil {
+		t.Error("Expected error writing to an aborted transfer")
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	"github.com/bgmerrell/tftpdmem/handlers/common"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+// An OptionHandler negotiates a single option (see RFC 2347) for a request.
+// It is given the value requested by the client and returns the value to
+// acknowledge in the OACK.  Returning ok == false declines the option, which
+// leaves it out of the OACK.  A non-nil error rejects the request.
+type OptionHandler func(req *Request, value string) (ack string, ok bool, err error)
+
+var (
+	optionHandlers = make(map[string]OptionHandler)
+	optionMu       sync.RWMutex
+)
+
+func init() {
+	RegisterOption("blksize", negotiateBlockSize)
+	RegisterOption("tsize", negotiateTransferSize)
+	RegisterOption("timeout", negotiateTimeout)
+	RegisterOption("windowsize", negotiateWindowSize)
+}
+
+// RegisterOption registers the handler for the named option.  Option names
+// are case insensitive.  Registering a name twice replaces the old handler.
+func RegisterOption(name string, handler OptionHandler) {
+	optionMu.Lock()
+	defer optionMu.Unlock()
+	optionHandlers[strings.ToLower(name)] = handler
+}
+
+// negotiate passes each of the request's options to its registered handler
+// and returns the options to acknowledge.  Options without a handler are
+// ignored as RFC 2347 requires.
+func negotiate(req *Request) ([]common.Option, error) {
+	var acks []common.Option
+	for _, opt := range req.Options {
+		optionMu.RLock()
+		handler, ok := optionHandlers[opt.Name]
+		optionMu.RUnlock()
+		if !ok {
+			continue
+		}
+		ack, ok, err := handler(req, opt.Value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			acks = append(acks, common.Option{Name: opt.Name, Value: ack})
+		}
+	}
+	return acks, nil
+}
+
+// negotiateBlockSize handles the blksize option (see RFC 2348).  Requests for
+// more than the server's maximum block size are answered with the maximum,
+// and invalid requests are declined.
+func negotiateBlockSize(req *Request, value string) (string, bool, error) {
+	blockSize, err := strconv.Atoi(value)
+	if err != nil || blockSize < defs.MinBlockSize {
+		return "", false, nil
+	}
+	if max := req.Server.Config().MaxBlockSize; blockSize > max {
+		blockSize = max
+	}
+	req.Opts.BlockSize = blockSize
+	return strconv.Itoa(blockSize), true, nil
+}
+
+// negotiateTransferSize handles the tsize option (see RFC 2349).  Readers are
+// told the size of the file as it will be transferred, which handleRequest
+// fills in once the file is opened, since it may be overwritten before then.
+// The size announced by a writer is reserved before the transfer starts, so
+// uploads that won't fit are refused up front.
+func negotiateTransferSize(req *Request, value string) (string, bool, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return "", false, nil
+	}
+	if !req.IsWrite {
+		return "", true, nil
+	}
+	if capacity := req.Server.FileManager().Capacity(); capacity > 0 && size > capacity {
+		return "", false, &errs.SrvError{Code: defs.ErrFull,
+			Msg: fmt.Sprintf("File too large: %d bytes", size)}
+	}
+	req.Opts.TransferSize = size
+	return strconv.Itoa(size), true, nil
+}
+
+// negotiateTimeout handles the timeout option (see RFC 2349), which is a
+// number of seconds from 1 to 255.  Invalid requests are declined.
+func negotiateTimeout(req *Request, value string) (string, bool, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < defs.MinTimeout || seconds > defs.MaxTimeout {
+		return "", false, nil
+	}
+	req.Opts.Timeout = time.Duration(seconds) * time.Second
+	return strconv.Itoa(seconds), true, nil
+}
+
+// negotiateWindowSize handles the windowsize option (see RFC 7440).  Requests
+// for more than the server's maximum window size are answered with the
+// maximum, and invalid requests are declined.
+func negotiateWindowSize(req *Request, value string) (string, bool, error) {
+	windowSize, err := strconv.Atoi(value)
+	if err != nil || windowSize < defs.MinWindowSize || windowSize > defs.MaxWindowSize {
+		return "", false, nil
+	}
+	if max := req.Server.Config().MaxWindowSize; windowSize > max {
+		windowSize = max
+	}
+	req.Opts.WindowSize = windowSize
+	return strconv.Itoa(windowSize), true, nil
+}
@@ -8,6 +8,9 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bgmerrell/tftpdmem/defs"
@@ -21,61 +24,174 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func HandleWriteRequest(buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fmgr.FileManager) ([]byte, error) {
-	return handleRequest(buf, conn, src, true, fm)
+func HandleWriteRequest(buf []byte, s *server.Server, src *net.UDPAddr) ([][]byte, error) {
+	return handleRequest(buf, s, src, true)
 }
 
-func HandleReadRequest(buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fmgr.FileManager) ([]byte, error) {
-	return handleRequest(buf, conn, src, false, fm)
+func HandleReadRequest(buf []byte, s *server.Server, src *net.UDPAddr) ([][]byte, error) {
+	return handleRequest(buf, s, src, false)
 }
 
-// startNewTransferServer starts a new server for the transferring data.  A
-// reference to the new server is returned.
-func startNewTransferServer(
-	conn *net.UDPConn,
+// newTransferServer returns a new server for transferring data with src on
+// behalf of the parent server.  It has a connection of its own unless the
+// parent is in single port mode.  The caller starts it.
+func newTransferServer(
+	parent *server.Server,
+	src *net.UDPAddr,
 	opCode uint16,
-	handler func(buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fmgr.FileManager) ([]byte, error),
-	fm *fmgr.FileManager) *server.Server {
+	handler func(buf []byte, s *server.Server, src *net.UDPAddr) ([][]byte, error),
+	opts fmgr.TransferOpts) (*server.Server, error) {
 	// Set up transfer server that handles data requests
-	opToHandle := server.OpToHandleMap{opCode: handler}
-	localPort := conn.LocalAddr().(*net.UDPAddr).Port
-	s := server.New(localPort, conn, opToHandle, true, fm)
-	go s.Serve()
-	return s
+	opToHandle := server.OpToHandleMap{
+		opCode:     handler,
+		defs.OpErr: HandleError}
+	var s *server.Server
+	if parent.Config().SinglePort {
+		// The client's packets all go to the transfer server now, so
+		// a retransmitted request ends up here too.  The transfer
+		// server retransmits its first response on its own.
+		opToHandle[defs.OpRrq] = ignoreRequest
+		opToHandle[defs.OpWrq] = ignoreRequest
+		var err error
+		s, err = parent.NewSharedTransferServer(opToHandle, src)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		conn, err := initTransferConn(
+			src, parent.LocalIP(src), parent.Config())
+		if err != nil {
+			return nil, &errs.SrvError{Code: defs.ErrGeneric, Msg: err.Error()}
+		}
+		// The port isn't enough to identify the transfer, since
+		// transfers on different local addresses may share it
+		s = server.New(parent.FileManager().NewTid(), conn, opToHandle,
+			true, parent.FileManager(), parent.Config())
+	}
+	s.SetBlockSize(opts.BlockSize)
+	s.SetTimeout(opts.Timeout)
+	return s, nil
 }
 
-// initTransferConn returns a new UDP conn to be used for data transfer.
-func initTransferConn(src *net.UDPAddr) (*net.UDPConn, error) {
-	laddr, err := net.ResolveUDPAddr("udp", "")
-	if err != nil {
-		msg := "Failed to resolve UDP addr: " + err.Error()
-		log.Println(msg)
-		return nil, errors.New(msg)
+// ignoreRequest ignores a retransmitted RRQ or WRQ
+func ignoreRequest(buf []byte, s *server.Server, src *net.UDPAddr) ([][]byte, error) {
+	return nil, errs.ErrPacketIgnored
+}
+
+// initTransferConn returns a new UDP conn to be used for data transfer with
+// src, on the same address family as src.  The conn is bound to localIP, the
+// address src sent its request to, if it is known; otherwise the kernel picks
+// the source address of each packet.  If the config limits the ports of
+// transfer conns, ports in the range are tried starting from a random one
+// until a free one is found.
+func initTransferConn(src *net.UDPAddr, localIP net.IP, cfg *server.Config) (*net.UDPConn, error) {
+	network := "udp6"
+	if src.IP.To4() != nil {
+		network = "udp4"
+	}
+	if localIP != nil && network == "udp4" {
+		localIP = localIP.To4()
+	}
+	if cfg.MinPort == 0 {
+		return listenTransferConn(network, localIP, 0)
 	}
-	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	numPorts := cfg.MaxPort - cfg.MinPort + 1
+	start := rand.Intn(numPorts)
+	for i := 0; i < numPorts; i++ {
+		port := cfg.MinPort + (start+i)%numPorts
+		conn, err := listenTransferConn(network, localIP, port)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	msg := fmt.Sprintf("No free transfer ports in range %d-%d",
+		cfg.MinPort, cfg.MaxPort)
+	log.Println(msg)
+	return nil, errors.New(msg)
+}
+
+// listenTransferConn returns a new UDP conn on ip (nil means any address) and
+// port (zero means any port)
+func listenTransferConn(network string, ip net.IP, port int) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
 	if err != nil {
-		msg := "ListenUDP failure: " + err.Error()
-		log.Println(msg)
-		return nil, errors.New(msg)
+		// Collisions are expected when searching a port range
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			log.Println("ListenUDP failure: " + err.Error())
+		}
+		return nil, fmt.Errorf("ListenUDP failure: %w", err)
 	}
 	return conn, err
 }
 
-func handleRequest(buf []byte, conn *net.UDPConn, src *net.UDPAddr, isWrite bool, fm *fmgr.FileManager) (resp []byte, err error) {
+// A Request is a parsed RRQ or WRQ
+type Request struct {
+	Filename string
+	Mode     string
+	IsWrite  bool
+	// Opts holds the transfer settings, which option handlers update as
+	// they negotiate.
+	Opts fmgr.TransferOpts
+	// Server is the server that received the request
+	Server *server.Server
+	// Options holds the options requested by the client (see RFC 2347) in
+	// the order they were requested.  Option names are lower case.
+	Options []common.Option
+}
+
+// parseRequest parses a RRQ or WRQ from the raw buf assuming the op code has
+// already been stripped off.
+func parseRequest(buf []byte, isWrite bool) (*Request, error) {
 	n := bytes.Index(buf, []byte{0})
 	if n < 1 {
-		return nil, &errs.SrvError{defs.ErrGeneric, "No filename provided"}
+		return nil, &errs.SrvError{Code: defs.ErrGeneric, Msg: "No filename provided"}
 	}
-	filename := string(buf[:n])
+	req := &Request{Filename: string(buf[:n]), IsWrite: isWrite}
 	buf = buf[n+1:]
 	n = bytes.Index(buf, []byte{0})
 	if n < 1 {
-		return nil, &errs.SrvError{defs.ErrGeneric, "No mode provided"}
+		return nil, &errs.SrvError{Code: defs.ErrGeneric, Msg: "No mode provided"}
+	}
+	req.Mode = string(buf[:n])
+	buf = buf[n+1:]
+
+	// Anything left over is a list of option name/value pairs.  Some
+	// clients pad requests with zeros, so an empty name ends the list.
+	for {
+		n = bytes.Index(buf, []byte{0})
+		if n < 1 {
+			break
+		}
+		name := strings.ToLower(string(buf[:n]))
+		buf = buf[n+1:]
+		n = bytes.Index(buf, []byte{0})
+		if n < 0 {
+			return nil, &errs.SrvError{Code: defs.ErrOptionNegotiation,
+				Msg: fmt.Sprintf("No value for option: %s", name)}
+		}
+		req.Options = append(req.Options,
+			common.Option{Name: name, Value: string(buf[:n])})
+		buf = buf[n+1:]
 	}
-	mode := string(buf[:n])
-	if mode != "octet" {
-		return nil, &errs.SrvError{defs.ErrGeneric,
-			fmt.Sprintf("Unsupported mode: %s", mode)}
+	return req, nil
+}
+
+func handleRequest(buf []byte, parent *server.Server, src *net.UDPAddr, isWrite bool) (resps [][]byte, err error) {
+	req, err := parseRequest(buf, isWrite)
+	if err != nil {
+		return nil, err
+	}
+	req.Server = parent
+	req.Opts.BlockSize = defs.BlockSize
+	req.Opts.Timeout = parent.Config().Timeout
+	req.Opts.Rollover = parent.Config().Rollover
+	req.Opts.Netascii = strings.EqualFold(req.Mode, "netascii")
+	req.Opts.IsWrite = isWrite
+	fm := parent.FileManager()
+	filename, mode := req.Filename, strings.ToLower(req.Mode)
+	if mode != "octet" && mode != "netascii" {
+		return nil, &errs.SrvError{Code: defs.ErrGeneric,
+			Msg: fmt.Sprintf("Unsupported mode: %s", req.Mode)}
 	}
 
 	if isWrite {
@@ -84,21 +200,39 @@ func handleRequest(buf []byte, conn *net.UDPConn, src *net.UDPAddr, isWrite bool
 		log.Printf("Read request for filename: %s, mode: %s", filename, mode)
 	}
 
-	conn, err = initTransferConn(src)
+	// Check if file exists (or may be overwritten)
+	exists := fm.FileExists(filename)
+	if isWrite {
+		if err := fm.CheckWrite(filename); err != nil {
+			return nil, err
+		}
+	} else if !exists {
+		return nil, &errs.SrvError{Code: defs.ErrFileNotFound,
+			Msg: fmt.Sprintf("Filename \"%s\" does not exists", filename)}
+	}
+
+	oackOpts, err := negotiate(req)
 	if err != nil {
-		return nil, &errs.SrvError{defs.ErrGeneric, err.Error()}
+		return nil, err
 	}
-	localPort := conn.LocalAddr().(*net.UDPAddr).Port
 
-	// Check if file exists
-	exists := fm.FileExists(filename)
-	if isWrite && exists {
-		return nil, &errs.SrvError{defs.ErrFileExists,
-			fmt.Sprintf("Filename \"%s\" already exists", filename)}
-	} else if !isWrite && !exists {
-		return nil, &errs.SrvError{defs.ErrFileNotFound,
-			fmt.Sprintf("Filename \"%s\" does not exists", filename)}
+	var s *server.Server
+	if isWrite {
+		s, err = newTransferServer(
+			parent, src, defs.OpData, HandleWriteData, req.Opts)
+	} else {
+		s, err = newTransferServer(
+			parent, src, defs.OpAck, HandleReadData, req.Opts)
+	}
+	if err != nil {
+		return nil, err
 	}
+	err = parent.AddTransfer(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	localTid := s.Tid()
 
 	// Add conn info to the file manager
 	var nextBlockNum uint16
@@ -107,46 +241,60 @@ func handleRequest(buf []byte, conn *net.UDPConn, src *net.UDPAddr, isWrite bool
 	} else {
 		nextBlockNum = 0
 	}
-	fm.AddConnInfo(localPort, src.Port, filename, nextBlockNum)
-
-	if isWrite {
-		resp, err = common.BuildAckPacket(0)
+	err = fm.AddConnInfo(localTid, src, filename, nextBlockNum, req.Opts)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if !isWrite {
+		// The file is opened before the OACK is built, so the size it
+		// announces is the size of the file the client will get.
+		size, err := fm.OpenRead(localTid)
 		if err != nil {
+			s.Close()
 			return nil, err
 		}
+		ackReadSize(oackOpts, size)
+	}
+
+	// An OACK takes the place of the first ACK (write) or DATA (read)
+	// packet, so the client answers it with DATA 1 or ACK 0 respectively;
+	// both are what the transfer server expects next.
+	var resp []byte
+	if len(oackOpts) > 0 {
+		resp, err = common.BuildOackPacket(oackOpts)
+	} else if isWrite {
+		resp, err = common.BuildAckPacket(0)
 	} else {
-		data, err := fm.Read(localPort, src.Port, 0)
-		if err != nil {
-			return nil, err
-		}
-		resp, err = common.BuildDataPacket(defs.FirstDataBlock, data)
-		if err != nil {
-			return nil, err
+		// Without options, the window is a single block
+		var blocks []fmgr.Block
+		blocks, err = fm.Read(localTid, src, 0)
+		if err == nil {
+			resp, err = common.BuildDataPacket(blocks[0].Num, blocks[0].Data)
 		}
 	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
 
-	var s *server.Server
-	if isWrite {
-		s = startNewTransferServer(conn, defs.OpData, HandleWriteData, fm)
-	} else {
-		s = startNewTransferServer(conn, defs.OpAck, HandleReadData, fm)
+	// Sending through the transfer server lets it retransmit the response
+	err = s.Respond([][]byte{resp}, src)
+	if err != nil {
+		s.Close()
+		return nil, errors.New(
+			"Error writing to UDP connection: " + err.Error())
 	}
+	parent.ServeTransfer(s)
+	return nil, nil
+}
 
-	n, err = conn.WriteToUDP(resp, src)
-	if err != nil || n != len(resp) {
-		var msg string
-		if err != nil {
-			msg = "Error writing to UDP connection: " + err.Error()
-		} else {
-			msg = fmt.Sprintf(
-				"Problem writing to UDP connection, %d of %d bytes written",
-				n, len(resp))
+// ackReadSize fills in the tsize option of a read's OACK, if there is one,
+// with size
+func ackReadSize(oackOpts []common.Option, size int) {
+	for i := range oackOpts {
+		if oackOpts[i].Name == "tsize" {
+			oackOpts[i].Value = strconv.Itoa(size)
 		}
-		log.Println(msg)
-		fm.DelConnInfo(localPort)
-		s.StopCh <- struct{}{}
-		conn.Close()
-		return nil, errors.New(msg)
 	}
-	return nil, nil
 }
@@ -2,12 +2,21 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"net"
+	"reflect"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/bgmerrell/tftpdmem/defs"
 	fmgr "github.com/bgmerrell/tftpdmem/filemanager"
+	"github.com/bgmerrell/tftpdmem/handlers/common"
+	"github.com/bgmerrell/tftpdmem/server"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
 )
 
 func TestHandleWriteRequest(t *testing.T) {
@@ -25,9 +34,8 @@ func TestHandleWriteRequest(t *testing.T) {
 	resp, err := HandleWriteRequest(
 		// foo\0octet\0
 		[]byte{0x66, 0x6f, 0x6f, 0x00, 0x6f, 0x63, 0x74, 0x65, 0x74, 0x00},
-		conn,
-		laddr,
-		fm)
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,9 +82,8 @@ func TestHandleReadRequest(t *testing.T) {
 	resp, err := HandleReadRequest(
 		// foo\0octet\0
 		[]byte{0x66, 0x6f, 0x6f, 0x00, 0x6f, 0x63, 0x74, 0x65, 0x74, 0x00},
-		conn,
-		laddr,
-		fm)
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,9 +125,8 @@ func TestHandleWriteRequestNoFilename(t *testing.T) {
 	_, err = HandleWriteRequest(
 		// \0octet\0
 		[]byte{0x00, 0x6f, 0x63, 0x74, 0x65, 0x74, 0x00},
-		conn,
-		laddr,
-		fm)
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
 	if err == nil {
 		t.Error("Expected error for write request w/o filename")
 	}
@@ -139,9 +145,8 @@ func TestHandleWriteRequestNoMode(t *testing.T) {
 	_, err = HandleWriteRequest(
 		// foo\0
 		[]byte{0x66, 0x6f, 0x6f, 0x00, 0x00},
-		conn,
-		laddr,
-		fm)
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
 	if err == nil {
 		t.Error("Expected error for write request w/o mode")
 	}
@@ -158,12 +163,699 @@ func TestHandleWriteRequestUnsupportedMode(t *testing.T) {
 	defer conn.Close()
 	laddr = conn.LocalAddr().(*net.UDPAddr)
 	_, err = HandleWriteRequest(
-		// foo\0netascii\0
-		[]byte{0x66, 0x6f, 0x6f, 0x00, 0x6e, 0x65, 0x74, 0x61, 0x73, 0x63, 0x69, 0x69, 0x00},
-		conn,
-		laddr,
-		fm)
+		// foo\0mail\0
+		[]byte{0x66, 0x6f, 0x6f, 0x00, 0x6d, 0x61, 0x69, 0x6c, 0x00},
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
 	if err == nil {
 		t.Error("Expected error for write request with unsupported mode")
 	}
 }
+
+func TestParseRequest(t *testing.T) {
+	req, err := parseRequest(
+		[]byte("foo\x00octet\x00BlkSize\x001024\x00tsize\x000\x00\x00"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Filename != "foo" || req.Mode != "octet" || req.IsWrite {
+		t.Errorf("Request: %#v, want foo/octet read", req)
+	}
+	expected := []common.Option{
+		{Name: "blksize", Value: "1024"}, {Name: "tsize", Value: "0"}}
+	if !reflect.DeepEqual(req.Options, expected) {
+		t.Errorf("Options: %#v, want: %#v", req.Options, expected)
+	}
+}
+
+func TestParseRequestNoOptionValue(t *testing.T) {
+	_, err := parseRequest([]byte("foo\x00octet\x00blksize\x001024"), false)
+	if err == nil {
+		t.Error("Expected error for option w/o value")
+	}
+}
+
+func TestHandleReadRequestOack(t *testing.T) {
+	RegisterOption("testopt", func(req *Request, value string) (string, bool, error) {
+		return value + "!", true, nil
+	})
+	filename := "foo"
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{filename: []byte("abc")})
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	_, err = HandleReadRequest(
+		[]byte("foo\x00octet\x00unknown\x001\x00TestOpt\x00yes\x00"),
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the registered option is acknowledged
+	expectedData := []byte("\x00\x06testopt\x00yes!\x00")
+	buf := make([]byte, defs.DatagramSize)
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf[:n], expectedData) != 0 {
+		t.Errorf("Data: %#v, want: %#v", buf[:n], expectedData)
+	}
+	// The client acknowledges the OACK with ACK 0 and gets the first block
+	_, err = conn.WriteToUDP([]byte{0x00, 0x04, 0x00, 0x00}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedData = []byte{0x00, 0x03, 0x00, 0x01, 0x61, 0x62, 0x63}
+	n, _, err = conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf[:n], expectedData) != 0 {
+		t.Errorf("Data: %#v, want: %#v", buf[:n], expectedData)
+	}
+}
+
+func TestHandleReadRequestBlockSize(t *testing.T) {
+	filename := "foo"
+	fm := fmgr.NewWithExistingFiles(
+		map[string][]byte{filename: []byte("abcdefghijk")})
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	cfg := server.DefaultConfig()
+	cfg.MaxBlockSize = 10
+	// The requested block size is more than the server allows
+	_, err = HandleReadRequest(
+		[]byte("foo\x00octet\x00blksize\x001428\x00"),
+		server.New(laddr.Port, conn, nil, false, fm, cfg),
+		laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{
+		[]byte("\x00\x06blksize\x0010\x00"),
+		[]byte("\x00\x03\x00\x01abcdefghij"),
+		[]byte("\x00\x03\x00\x02k")}
+	buf := make([]byte, defs.DatagramSize)
+	for i, expectedData := range expected {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(buf[:n], expectedData) != 0 {
+			t.Errorf("Data: %q, want: %q", buf[:n], expectedData)
+		}
+		ack := []byte{0x00, 0x04, 0x00, byte(i)}
+		_, err = conn.WriteToUDP(ack, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleWriteRequestBlockSize(t *testing.T) {
+	fm := fmgr.New()
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	_, err = HandleWriteRequest(
+		[]byte("foo\x00octet\x00blksize\x008\x00"),
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{
+		[]byte("\x00\x06blksize\x008\x00"),
+		[]byte("\x00\x04\x00\x01"),
+		[]byte("\x00\x04\x00\x02")}
+	toSend := [][]byte{
+		[]byte("\x00\x03\x00\x01abcdefgh"),
+		[]byte("\x00\x03\x00\x02ij")}
+	buf := make([]byte, defs.DatagramSize)
+	for i, expectedData := range expected {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(buf[:n], expectedData) != 0 {
+			t.Errorf("Data: %q, want: %q", buf[:n], expectedData)
+		}
+		if i < len(toSend) {
+			_, err = conn.WriteToUDP(toSend[i], addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !fm.FileExists("foo") {
+		t.Error("Expected filename \"foo\" to exist")
+	}
+}
+
+func TestHandleReadRequestTransferSize(t *testing.T) {
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	_, err = HandleReadRequest(
+		[]byte("foo\x00octet\x00tsize\x000\x00"),
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedData := []byte("\x00\x06tsize\x003\x00")
+	buf := make([]byte, defs.DatagramSize)
+	n, transferAddr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf[:n], expectedData) != 0 {
+		t.Errorf("Data: %q, want: %q", buf[:n], expectedData)
+	}
+
+	// The client gets the file it was told the size of, even if it's
+	// overwritten before the transfer starts
+	fm.SetOverwritePolicy(fmgr.Overwrite)
+	if err := fm.AddFile("foo", []byte("zyxwvu")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteToUDP([]byte{0x00, 0x04, 0x00, 0x00}, transferAddr); err != nil {
+		t.Fatal(err)
+	}
+	expectedData = []byte("\x00\x03\x00\x01abc")
+	n, _, err = conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(buf[:n], expectedData) != 0 {
+		t.Errorf("Data: %q, want: %q", buf[:n], expectedData)
+	}
+}
+
+func TestHandleWriteRequestTransferSizeFull(t *testing.T) {
+	fm := fmgr.New()
+	fm.SetCapacity(100)
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig())
+	for _, tsize := range []string{"101", strconv.Itoa(math.MaxInt)} {
+		_, err = HandleWriteRequest(
+			[]byte("foo\x00octet\x00tsize\x00"+tsize+"\x00"), s, laddr)
+		if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFull {
+			t.Errorf("tsize %s: got err: %#v, want ErrFull", tsize, err)
+		}
+	}
+}
+
+func TestHandleWriteRequestTimeout(t *testing.T) {
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(laddr.Port, conn, nil, false, fmgr.New(), server.DefaultConfig())
+	tests := []struct {
+		req      string
+		expected string
+	}{
+		{"foo\x00octet\x00timeout\x003\x00", "\x00\x06timeout\x003\x00"},
+		// Out of range, so declined
+		{"bar\x00octet\x00timeout\x00256\x00", "\x00\x04\x00\x00"},
+	}
+	buf := make([]byte, defs.DatagramSize)
+	for _, test := range tests {
+		_, err = HandleWriteRequest([]byte(test.req), s, laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != test.expected {
+			t.Errorf("Data: %q, want: %q", buf[:n], test.expected)
+		}
+	}
+}
+
+func TestHandleReadRequestWindowSize(t *testing.T) {
+	fm := fmgr.NewWithExistingFiles(
+		map[string][]byte{"foo": []byte("abcdefghijklmnopqrst")})
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	_, err = HandleReadRequest(
+		[]byte("foo\x00octet\x00blksize\x008\x00windowsize\x002\x00"),
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expected []string
+		ack      []byte
+	}{
+		{[]string{"\x00\x06blksize\x008\x00windowsize\x002\x00"},
+			[]byte{0x00, 0x04, 0x00, 0x00}},
+		{[]string{"\x00\x03\x00\x01abcdefgh", "\x00\x03\x00\x02ijklmnop"},
+			[]byte{0x00, 0x04, 0x00, 0x02}},
+		{[]string{"\x00\x03\x00\x03qrst"},
+			[]byte{0x00, 0x04, 0x00, 0x03}},
+	}
+	buf := make([]byte, defs.DatagramSize)
+	for _, test := range tests {
+		var addr *net.UDPAddr
+		for _, expected := range test.expected {
+			var n int
+			n, addr, err = conn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != expected {
+				t.Errorf("Data: %q, want: %q", buf[:n], expected)
+			}
+		}
+		_, err = conn.WriteToUDP(test.ack, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleReadRequestNetascii(t *testing.T) {
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{"foo": []byte("abcdefg\n")})
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	// The mode is case insensitive
+	_, err = HandleReadRequest(
+		[]byte("foo\x00NetASCII\x00tsize\x000\x00blksize\x008\x00"),
+		server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig()),
+		laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The CR LF straddles the two blocks
+	expected := [][]byte{
+		[]byte("\x00\x06tsize\x009\x00blksize\x008\x00"),
+		[]byte("\x00\x03\x00\x01abcdefg\r"),
+		[]byte("\x00\x03\x00\x02\n")}
+	buf := make([]byte, defs.DatagramSize)
+	for i, expectedData := range expected {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(buf[:n], expectedData) != 0 {
+			t.Errorf("Data: %q, want: %q", buf[:n], expectedData)
+		}
+		ack := []byte{0x00, 0x04, 0x00, byte(i)}
+		_, err = conn.WriteToUDP(ack, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleWriteRequestOverwrite(t *testing.T) {
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig())
+	_, err = HandleWriteRequest([]byte("foo\x00octet\x00"), s, laddr)
+	if srvErr, ok := err.(*errs.SrvError); !ok || srvErr.Code != defs.ErrFileExists {
+		t.Fatalf("Got err: %#v, want ErrFileExists", err)
+	}
+
+	fm.SetOverwritePolicy(fmgr.Overwrite)
+	_, err = HandleWriteRequest([]byte("foo\x00octet\x00"), s, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{
+		[]byte("\x00\x04\x00\x00"),
+		[]byte("\x00\x04\x00\x01")}
+	toSend := [][]byte{[]byte("\x00\x03\x00\x01wxyz")}
+	buf := make([]byte, defs.DatagramSize)
+	for i, expectedData := range expected {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(buf[:n], expectedData) != 0 {
+			t.Errorf("Data: %q, want: %q", buf[:n], expectedData)
+		}
+		if i < len(toSend) {
+			_, err = conn.WriteToUDP(toSend[i], addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	size, err := fm.FileSize("foo")
+	if err != nil || size != 4 {
+		t.Errorf("size: %d (%v), want: 4", size, err)
+	}
+}
+
+func TestHandleWriteRequestRetransmitted(t *testing.T) {
+	fm := fmgr.New()
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer conn.Close()
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	s := server.New(laddr.Port, conn, nil, false, fm, server.DefaultConfig())
+	defer s.Close()
+	_, err = HandleWriteRequest([]byte("foo\x00octet\x00"), s, laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client resends its request before it gets ACK 0, which the
+	// transfer already under way answers
+	_, err = HandleWriteRequest([]byte("foo\x00octet\x00"), s, laddr)
+	if err != errs.ErrPacketIgnored {
+		t.Fatalf("err: %v, want: %v", err, errs.ErrPacketIgnored)
+	}
+	buf := make([]byte, defs.DatagramSize)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "\x00\x04\x00\x00" {
+		t.Errorf("Data: %q, want: %q", buf[:n], "\x00\x04\x00\x00")
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := conn.ReadFromUDP(buf); err == nil {
+		t.Errorf("Got unexpected packet: %q", buf[:n])
+	}
+}
+
+func TestSinglePort(t *testing.T) {
+	fm := fmgr.New()
+	laddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	conn, err := net.ListenUDP(laddr.Network(), laddr)
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	laddr = conn.LocalAddr().(*net.UDPAddr)
+	cfg := server.DefaultConfig()
+	cfg.SinglePort = true
+	cfg.Timeout = 100 * time.Millisecond
+	opToHandle := server.OpToHandleMap{
+		defs.OpWrq: HandleWriteRequest,
+		defs.OpRrq: HandleReadRequest}
+	s := server.New(laddr.Port, conn, opToHandle, false, fm, cfg)
+	go s.Serve(context.Background())
+	defer s.Close()
+
+	// Two clients write at once
+	var clients []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		c, err := net.ListenUDP(laddr.Network(), &net.UDPAddr{IP: laddr.IP})
+		if err != nil {
+			t.Fatal("Failed to get UDP conn:", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		clients = append(clients, c)
+	}
+	exchange := func(c *net.UDPConn, send string, expected string) {
+		_, err := c.WriteToUDP([]byte(send), laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, defs.DatagramSize)
+		n, addr, err := c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every response comes from the main port
+		if addr.Port != laddr.Port {
+			t.Errorf("Port: %d, want: %d", addr.Port, laddr.Port)
+		}
+		if string(buf[:n]) != expected {
+			t.Errorf("Data: %q, want: %q", buf[:n], expected)
+		}
+	}
+	for i, c := range clients {
+		exchange(c, fmt.Sprintf("\x00\x02f%d\x00octet\x00", i), "\x00\x04\x00\x00")
+	}
+	for i, c := range clients {
+		exchange(c, fmt.Sprintf("\x00\x03\x00\x01data%d", i), "\x00\x04\x00\x01")
+	}
+	for i := range clients {
+		size, err := fm.FileSize(fmt.Sprintf("f%d", i))
+		if err != nil || size != 5 {
+			t.Errorf("size: %d (%v), want: 5", size, err)
+		}
+	}
+
+	// And read one back
+	exchange(clients[0], "\x00\x01f1\x00octet\x00", "\x00\x03\x00\x01data1")
+	_, err = clients[0].WriteToUDP([]byte("\x00\x04\x00\x01"), laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitTransferConnPortRange(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5678}
+	// Find a free port, and take the one above it
+	conn, err := initTransferConn(src, nil, server.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	taken, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port + 1})
+	if err != nil {
+		t.Skip("Port above free port is in use:", err)
+	}
+	defer taken.Close()
+
+	cfg := server.DefaultConfig()
+	cfg.MinPort, cfg.MaxPort = port, port+1
+	// The free port is found whichever port is tried first
+	for i := 0; i < 4; i++ {
+		conn, err = initTransferConn(src, nil, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := conn.LocalAddr().(*net.UDPAddr).Port; p != port {
+			t.Errorf("Port: %d, want: %d", p, port)
+		}
+		conn.Close()
+	}
+	// Until the range is used up
+	cfg.MinPort = port + 1
+	_, err = initTransferConn(src, nil, cfg)
+	if err == nil {
+		t.Error("Expected error with no free ports in range")
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	// The wildcard address with the udp network is dual-stack
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skip("No IPv6 support:", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	cfg := server.DefaultConfig()
+	cfg.Timeout = 100 * time.Millisecond
+	opToHandle := server.OpToHandleMap{defs.OpRrq: HandleReadRequest}
+	s := server.New(port, conn, opToHandle, false, fm, cfg)
+	go s.Serve(context.Background())
+	defer s.Close()
+
+	for _, ip := range []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback} {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Skip("No loopback address:", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = c.WriteToUDP([]byte("\x00\x01foo\x00octet\x00"),
+			&net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, defs.DatagramSize)
+		n, addr, err := c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "\x00\x03\x00\x01abc" {
+			t.Errorf("Data: %q, want: %q", buf[:n], "\x00\x03\x00\x01abc")
+		}
+		// The transfer uses the client's address family
+		if (addr.IP.To4() == nil) != (ip.To4() == nil) {
+			t.Errorf("Got DATA from %s for client %s", addr, c.LocalAddr())
+		}
+		if !addr.IP.Equal(ip) {
+			t.Errorf("IP: %s, want: %s", addr.IP, ip)
+		}
+	}
+}
+
+func TestReplyFromRequestDestination(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Request destinations are only known on Linux")
+	}
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	// All of 127.0.0.0/8 is local on Linux, so a server on the wildcard
+	// address looks multi-homed
+	dstIP := net.ParseIP("127.0.0.2")
+	for _, singlePort := range []bool{false, true} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		if err != nil {
+			t.Fatal("Failed to get UDP conn:", err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		cfg := server.DefaultConfig()
+		cfg.Timeout = 100 * time.Millisecond
+		cfg.SinglePort = singlePort
+		opToHandle := server.OpToHandleMap{defs.OpRrq: HandleReadRequest}
+		s := server.New(port, conn, opToHandle, false, fm, cfg)
+		go s.Serve(context.Background())
+
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal("Failed to get UDP conn:", err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		// The main server's own replies come from there too
+		_, err = c.WriteToUDP([]byte("\x00\x01missing\x00octet\x00"),
+			&net.UDPAddr{IP: dstIP, Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, defs.DatagramSize)
+		n, addr, err := c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf[:n], []byte("\x00\x05\x00\x01")) {
+			t.Errorf("Data: %q, want: file not found", buf[:n])
+		}
+		if !addr.IP.Equal(dstIP) {
+			t.Errorf("single port %t: ERROR from IP: %s, want: %s",
+				singlePort, addr.IP, dstIP)
+		}
+
+		_, err = c.WriteToUDP([]byte("\x00\x01foo\x00octet\x00"),
+			&net.UDPAddr{IP: dstIP, Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, addr, err = c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "\x00\x03\x00\x01abc" {
+			t.Errorf("Data: %q, want: %q", buf[:n], "\x00\x03\x00\x01abc")
+		}
+		if !addr.IP.Equal(dstIP) {
+			t.Errorf("single port %t: IP: %s, want: %s",
+				singlePort, addr.IP, dstIP)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestTransfersShareLocalPort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Request destinations are only known on Linux")
+	}
+	fm := fmgr.NewWithExistingFiles(map[string][]byte{"foo": []byte("abc")})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	// Transfers to different local addresses can be given the same port
+	free, err := initTransferConn(
+		&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil, server.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferPort := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+	cfg := server.DefaultConfig()
+	cfg.Timeout = 100 * time.Millisecond
+	cfg.MinPort, cfg.MaxPort = transferPort, transferPort
+	opToHandle := server.OpToHandleMap{defs.OpRrq: HandleReadRequest}
+	s := server.New(port, conn, opToHandle, false, fm, cfg)
+	go s.Serve(context.Background())
+	defer s.Close()
+
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal("Failed to get UDP conn:", err)
+	}
+	defer c.Close()
+	// The first transfer is still open when the second starts
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = c.WriteToUDP([]byte("\x00\x01foo\x00octet\x00"),
+			&net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, defs.DatagramSize)
+		n, addr, err := c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "\x00\x03\x00\x01abc" {
+			t.Errorf("%s: Data: %q, want: %q", ip, buf[:n], "\x00\x03\x00\x01abc")
+		}
+		if addr.Port != transferPort {
+			t.Errorf("%s: Port: %d, want: %d", ip, addr.Port, transferPort)
+		}
+	}
+}
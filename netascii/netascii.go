@@ -0,0 +1,80 @@
+// Package netascii translates between local text and netascii (see RFC 764),
+// which ends lines with CR LF and escapes a bare CR as CR NUL.
+package netascii
+
+const (
+	cr  = '\r'
+	lf  = '\n'
+	nul = 0
+)
+
+// Encode returns data translated to netascii
+func Encode(data []byte) []byte {
+	encoded := make([]byte, 0, EncodedLen(data))
+	for _, b := range data {
+		switch b {
+		case lf:
+			encoded = append(encoded, cr, lf)
+		case cr:
+			encoded = append(encoded, cr, nul)
+		default:
+			encoded = append(encoded, b)
+		}
+	}
+	return encoded
+}
+
+// EncodedLen returns the length of data once translated to netascii
+func EncodedLen(data []byte) int {
+	n := len(data)
+	for _, b := range data {
+		if b == lf || b == cr {
+			n++
+		}
+	}
+	return n
+}
+
+// A Decoder translates netascii back to local text a block at a time.  An
+// escape sequence can straddle two blocks, so a CR at the end of a block is
+// held until the next block shows what follows it.
+type Decoder struct {
+	pendingCR bool
+}
+
+// Decode returns block translated from netascii
+func (d *Decoder) Decode(block []byte) []byte {
+	decoded := make([]byte, 0, len(block)+1)
+	for _, b := range block {
+		if d.pendingCR {
+			d.pendingCR = false
+			switch b {
+			case lf:
+				decoded = append(decoded, lf)
+				continue
+			case nul:
+				decoded = append(decoded, cr)
+				continue
+			default:
+				// Not valid netascii, but keep the CR rather
+				// than lose data.
+				decoded = append(decoded, cr)
+			}
+		}
+		if b == cr {
+			d.pendingCR = true
+		} else {
+			decoded = append(decoded, b)
+		}
+	}
+	return decoded
+}
+
+// Flush returns anything held back at the end of the transfer
+func (d *Decoder) Flush() []byte {
+	if d.pendingCR {
+		d.pendingCR = false
+		return []byte{cr}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package netascii
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	data := []byte("a\nb\rc\r\n")
+	expected := []byte("a\r\nb\r\x00c\r\x00\r\n")
+	encoded := Encode(data)
+	if bytes.Compare(encoded, expected) != 0 {
+		t.Errorf("Got %q, want %q", encoded, expected)
+	}
+	if n := EncodedLen(data); n != len(expected) {
+		t.Errorf("EncodedLen: %d, want: %d", n, len(expected))
+	}
+}
+
+func TestDecode(t *testing.T) {
+	// Escape sequences straddle the blocks
+	blocks := [][]byte{
+		[]byte("a\r"), []byte("\nb\r"), []byte("\x00c\r"), []byte("x\r")}
+	expected := []byte("a\nb\rc\rx\r")
+	var d Decoder
+	var decoded []byte
+	for _, block := range blocks {
+		decoded = append(decoded, d.Decode(block)...)
+	}
+	decoded = append(decoded, d.Flush()...)
+	if bytes.Compare(decoded, expected) != 0 {
+		t.Errorf("Got %q, want %q", decoded, expected)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	data := []byte("line 1\nline 2\r\n\rline 3\n")
+	encoded := Encode(data)
+	var d Decoder
+	var decoded []byte
+	// Decode a byte at a time to exercise every block boundary
+	for i := range encoded {
+		decoded = append(decoded, d.Decode(encoded[i:i+1])...)
+	}
+	decoded = append(decoded, d.Flush()...)
+	if bytes.Compare(decoded, data) != 0 {
+		t.Errorf("Got %q, want %q", decoded, data)
+	}
+}
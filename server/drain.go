@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+// AddTransfer registers transfer server t as one of s's transfers, so that s
+// can drain it on shutdown.  It fails once s is draining, so that no new
+// transfers start.  t is unregistered when it is closed.
+func (s *Server) AddTransfer(t *Server) error {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	if s.draining {
+		return errs.ErrShuttingDown
+	}
+	s.active[t] = struct{}{}
+	t.owner = s
+	return nil
+}
+
+// removeActive unregisters transfer server t, letting Shutdown know once the
+// last one is gone
+func (s *Server) removeActive(t *Server) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	delete(s.active, t)
+	if len(s.active) == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// Shutdown stops s from starting new transfers and waits until the transfers
+// in progress end or ctx is done.  Transfers still running after that are
+// aborted, and their clients are sent an ERROR packet.  Then s is closed.
+// Shutdown returns once Serve has returned, with a description of each
+// aborted transfer and, if there were any, ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) ([]string, error) {
+	idle := s.startDrain()
+	var interrupted []string
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		interrupted = s.abortTransfers()
+		<-idle
+	}
+	s.Close()
+
+	s.transfersMu.Lock()
+	served := s.serving
+	s.transfersMu.Unlock()
+	if served != nil {
+		<-served
+	}
+	s.wg.Wait()
+	if interrupted != nil {
+		return interrupted, ctx.Err()
+	}
+	return nil, nil
+}
+
+// stopTransfers aborts the main server's transfers and waits for all of its
+// goroutines to exit
+func (s *Server) stopTransfers() {
+	s.startDrain()
+	s.abortTransfers()
+	s.wg.Wait()
+}
+
+// abortTransfers aborts the main server's transfers and returns their
+// descriptions
+func (s *Server) abortTransfers() []string {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	var interrupted []string
+	for t := range s.active {
+		interrupted = append(interrupted, t.describe())
+		t.abort()
+	}
+	return interrupted
+}
+
+// startDrain stops s from starting new transfers and returns a channel that
+// is closed once it has no transfers left
+func (s *Server) startDrain() chan struct{} {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	s.draining = true
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+		if len(s.active) == 0 {
+			close(s.idle)
+		}
+	}
+	return s.idle
+}
+
+// describe returns a description of a transfer server's transfer for logging
+func (s *Server) describe() string {
+	desc := s.fileManager.DescribeTransfer(s.Tid())
+	if desc == "" {
+		desc = fmt.Sprintf("transfer %d", s.Tid())
+	}
+	return desc
+}
+
+// abort tells a transfer server to stop, waking it up if it's waiting for a
+// packet.  The transfer server sends its client an ERROR packet as it stops.
+func (s *Server) abort() {
+	s.abortOnce.Do(func() {
+		close(s.abortCh)
+		// Closing abortCh first means that either read sees it or this
+		// deadline comes after the one read sets.
+		if s.packets == nil {
+			s.conn.SetReadDeadline(time.Now())
+		}
+	})
+}
+
+// aborted returns whether the transfer server has been told to stop
+func (s *Server) aborted() bool {
+	select {
+	case <-s.abortCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportAborted logs the abort of a transfer server and tells its client
+func (s *Server) reportAborted() {
+	log.Printf("Aborting %s", s.describe())
+	if s.lastDst != nil {
+		s.respondWithErr(errs.ErrShuttingDown, s.lastDst, nil)
+	}
+}
@@ -2,16 +2,34 @@
 package errors
 
 import (
+	"errors"
 	"fmt"
 )
 
+// ErrTransferDone is returned by a transfer's handlers once the transfer is
+// complete.
+var ErrTransferDone = errors.New("Transfer done")
+
+// ErrPacketIgnored is returned by a transfer's handlers for a packet that
+// needs no response, such as a duplicate ACK.
+var ErrPacketIgnored = errors.New("Packet ignored")
+
+// ErrShuttingDown is returned for requests that arrive while the server is
+// shutting down, and sent to the clients of transfers it aborts.
+var ErrShuttingDown = errors.New("Server is shutting down")
+
+// ErrServerClosed is returned by Serve once the server is closed
+var ErrServerClosed = errors.New("Server closed")
+
+// An UnexpectedRemoteTidErr is returned for a packet from a host other than
+// the client of a transfer.  The TIDs are full addresses (IP:port).
 type UnexpectedRemoteTidErr struct {
-	Tid         int
-	ExpectedTid int
+	Tid         string
+	ExpectedTid string
 }
 
 func (e UnexpectedRemoteTidErr) Error() string {
-	return fmt.Sprintf("Got remote tid: %d, want %d", e.Tid, e.ExpectedTid)
+	return fmt.Sprintf("Got remote tid: %s, want %s", e.Tid, e.ExpectedTid)
 }
 
 type SrvError struct {
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// pktInfoOobSize is large enough for either kind of packet info message
+var pktInfoOobSize = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePktInfo asks the kernel to report the destination address of each
+// packet read from conn (see IP_PKTINFO and IPV6_PKTINFO).  Sockets bound to
+// the IPv6 wildcard address get both, since they also receive IPv4 packets.
+func enablePktInfo(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	isV4 := conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if isV4 {
+			sockErr = syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(
+			int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parsePktInfo returns the destination address from the packet info in oob,
+// or nil if there is none
+func parsePktInfo(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP &&
+			msg.Header.Type == syscall.IP_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3])
+		case msg.Header.Level == syscall.IPPROTO_IPV6 &&
+			msg.Header.Type == syscall.IPV6_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr[:])
+			return ip
+		}
+	}
+	return nil
+}
+
+// buildPktInfo returns the packet info that sends a packet from ip
+func buildPktInfo(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		copy(info.Spec_dst[:], ip4)
+		return oob
+	}
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IPV6
+	h.Type = syscall.IPV6_PKTINFO
+	h.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+	info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	copy(info.Addr[:], ip.To16())
+	return oob
+}
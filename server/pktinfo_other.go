@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+const pktInfoOobSize = 0
+
+// enablePktInfo fails, since packet info is only supported on Linux
+func enablePktInfo(conn *net.UDPConn) error {
+	return errors.New("Packet info is not supported on this platform")
+}
+
+func parsePktInfo(oob []byte) net.IP {
+	return nil
+}
+
+func buildPktInfo(ip net.IP) []byte {
+	return nil
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/bgmerrell/tftpdmem/defs"
@@ -15,115 +17,517 @@ import (
 	"github.com/bgmerrell/tftpdmem/util"
 )
 
-var readTimeout time.Duration = 10 * time.Second
-
+// An OpToHandleMap maps op codes to the functions that handle them.  A handler
+// is given a packet (with the op code stripped off) and returns the packets to
+// send back to src, if any.
 type OpToHandleMap map[uint16]func(
-	buf []byte, conn *net.UDPConn, src *net.UDPAddr, fm *fmgr.FileManager) ([]byte, error)
+	buf []byte, s *Server, src *net.UDPAddr) ([][]byte, error)
+
+// Config holds the settings shared by a server and the transfer servers that
+// are started on its behalf.
+type Config struct {
+	// MaxBlockSize is the largest block size that a client can negotiate
+	// with the blksize option.
+	MaxBlockSize int
+	// MaxWindowSize is the largest window size that a client can
+	// negotiate with the windowsize option.
+	MaxWindowSize int
+	// Rollover is the block number (0 or 1) that follows block 65535 in
+	// transfers of more than 65535 blocks.
+	Rollover int
+	// Timeout is how long a transfer server waits for the client before
+	// retransmitting, unless the client negotiates another timeout with
+	// the timeout option.
+	Timeout time.Duration
+	// Retries is how many times a transfer server retransmits before it
+	// gives up on the client.
+	Retries int
+	// Backoff doubles the timeout after each retransmission, up to
+	// defs.MaxTimeout seconds (or Timeout, if that's longer)
+	Backoff bool
+	// SinglePort runs transfers over the main server's connection instead
+	// of a new connection each, so that only the one port needs to be
+	// open.  The main server passes each client's packets on to its
+	// transfer server.
+	SinglePort bool
+	// MinPort and MaxPort limit the ports of transfer connections, so that
+	// firewall rules can be narrow.  Zero for both means any port.
+	MinPort int
+	MaxPort int
+}
+
+// Validate returns an error if any of the settings is out of range.  Zero is
+// out of range for MaxBlockSize, MaxWindowSize, and Timeout, so a Config is
+// best started from DefaultConfig.
+func (c *Config) Validate() error {
+	if c.MaxBlockSize < defs.MinBlockSize || c.MaxBlockSize > defs.MaxBlockSize {
+		return errors.New(fmt.Sprintf(
+			"Invalid max block size: %d (must be %d to %d)",
+			c.MaxBlockSize, defs.MinBlockSize, defs.MaxBlockSize))
+	}
+	if c.MaxWindowSize < defs.MinWindowSize || c.MaxWindowSize > defs.MaxWindowSize {
+		return errors.New(fmt.Sprintf(
+			"Invalid max window size: %d (must be %d to %d)",
+			c.MaxWindowSize, defs.MinWindowSize, defs.MaxWindowSize))
+	}
+	if c.Rollover != 0 && c.Rollover != 1 {
+		return errors.New(fmt.Sprintf(
+			"Invalid rollover: %d (must be 0 or 1)", c.Rollover))
+	}
+	if c.Timeout <= 0 {
+		return errors.New(fmt.Sprintf(
+			"Invalid timeout: %s (must be positive)", c.Timeout))
+	}
+	if c.Retries < 0 {
+		return errors.New(fmt.Sprintf(
+			"Invalid retries: %d (must not be negative)", c.Retries))
+	}
+	if c.MinPort == 0 && c.MaxPort == 0 {
+		return nil
+	}
+	if c.MinPort < 1 || c.MinPort > c.MaxPort || c.MaxPort > 0xffff {
+		return errors.New(fmt.Sprintf(
+			"Invalid port range: %d-%d", c.MinPort, c.MaxPort))
+	}
+	return nil
+}
+
+// DefaultConfig returns a new Config with the default settings
+func DefaultConfig() *Config {
+	return &Config{
+		MaxBlockSize:  defs.MaxBlockSize,
+		MaxWindowSize: 64,
+		Timeout:       10 * time.Second,
+		Retries:       5}
+}
 
 type Server struct {
-	port             int
+	tid              int
 	conn             *net.UDPConn
 	opToHandle       OpToHandleMap
 	isTransferServer bool
-	StopCh           chan struct{}
 	fileManager      *fmgr.FileManager
+	config           *Config
+	blockSize        int
+	timeout          time.Duration
+	// A transfer server keeps the last packets it sent so that it can
+	// retransmit them if the client hasn't made progress by the deadline.
+	lastResps [][]byte
+	lastDst   *net.UDPAddr
+	retries   int
+	deadline  time.Time
+	// In single port mode (see Config.SinglePort), the main server keeps
+	// its transfer servers by client address and passes them their
+	// packets.
+	transfers   map[string]*Server
+	transfersMu sync.Mutex
+	packets     chan packet
+	parent      *Server
+	peer        *net.UDPAddr
+	// On a multi-homed host, replies must come from the address that a
+	// client sent its request to.  The main server keeps the destination
+	// address of each request it is handling by client address, and a
+	// transfer server that shares its connection sends from localIP.
+	pktInfo  bool
+	localIPs map[string]net.IP
+	localIP  net.IP
+	// The main server keeps its active transfer servers so that it can
+	// drain them on shutdown (see drain.go).  active, draining, and idle
+	// are guarded by transfersMu.  A transfer server's owner is the main
+	// server that started it, and abortCh is closed to abort it.
+	active    map[*Server]struct{}
+	draining  bool
+	idle      chan struct{}
+	owner     *Server
+	abortCh   chan struct{}
+	abortOnce sync.Once
+	// wg counts the main server's request and transfer goroutines, and
+	// serving is closed once Serve (if it was started) returns.
+	wg          sync.WaitGroup
+	serving     chan struct{}
+	releaseOnce sync.Once
 }
 
-func New(port int, conn *net.UDPConn, opToHandle OpToHandleMap, isTransferServer bool, fm *fmgr.FileManager) *Server {
-	return &Server{port,
-		conn,
-		opToHandle,
-		isTransferServer,
-		make(chan struct{}),
-		fm}
+func New(tid int, conn *net.UDPConn, opToHandle OpToHandleMap, isTransferServer bool, fm *fmgr.FileManager, cfg *Config) *Server {
+	s := &Server{
+		tid:              tid,
+		conn:             conn,
+		opToHandle:       opToHandle,
+		isTransferServer: isTransferServer,
+		fileManager:      fm,
+		config:           cfg,
+		blockSize:        defs.BlockSize,
+		timeout:          cfg.Timeout,
+		transfers:        make(map[string]*Server),
+		localIPs:         make(map[string]net.IP),
+		active:           make(map[*Server]struct{}),
+		abortCh:          make(chan struct{})}
+	if !isTransferServer && conn != nil {
+		err := enablePktInfo(conn)
+		if err != nil {
+			log.Println("Unable to get request destination addresses:", err)
+		}
+		s.pktInfo = err == nil
+	}
+	return s
 }
 
-func (s *Server) Serve() {
-	for {
+// Tid returns the server's local TID, which identifies a transfer server's
+// transfer to the file manager (see FileManager.NewTid)
+func (s *Server) Tid() int {
+	return s.tid
+}
+
+// Conn returns the server's UDP connection
+func (s *Server) Conn() *net.UDPConn {
+	return s.conn
+}
+
+// LocalIP returns the address that the client at src sent its request to, so
+// that the transfer can be answered from it.  It is nil if the server is
+// listening on the wildcard address and the destination is unknown.
+func (s *Server) LocalIP(src *net.UDPAddr) net.IP {
+	s.transfersMu.Lock()
+	ip := s.localIPs[src.String()]
+	s.transfersMu.Unlock()
+	if ip != nil {
+		return ip
+	}
+	if ip := s.conn.LocalAddr().(*net.UDPAddr).IP; !ip.IsUnspecified() {
+		return ip
+	}
+	return nil
+}
+
+// FileManager returns the server's file manager
+func (s *Server) FileManager() *fmgr.FileManager {
+	return s.fileManager
+}
+
+// Config returns the server's config
+func (s *Server) Config() *Config {
+	return s.config
+}
+
+// SetBlockSize sets the block size of a transfer server, which determines the
+// size of the datagrams it reads.  It must be called before Serve.
+func (s *Server) SetBlockSize(blockSize int) {
+	s.blockSize = blockSize
+}
+
+// SetTimeout sets how long the server waits to read a packet.  It must be
+// called before Serve.
+func (s *Server) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// Serve handles packets until the server is closed or ctx is done.  A
+// transfer server also stops once its transfer ends, in which case Serve
+// returns nil.  Otherwise it returns ErrServerClosed after Close or Shutdown,
+// or ctx.Err() once ctx is done.
+//
+// The main server aborts any transfers still running as it stops, and Serve
+// doesn't return until all of its goroutines have exited.
+func (s *Server) Serve(ctx context.Context) error {
+	s.transfersMu.Lock()
+	s.serving = make(chan struct{})
+	served := s.serving
+	s.transfersMu.Unlock()
+	defer close(served)
+
+	stopped := make(chan struct{})
+	go func() {
 		select {
-		// Stop and close the connection
-		case <-s.StopCh:
-			s.conn.Close()
-			return
-		default:
-			buf := make([]byte, defs.DatagramSize)
-			t := time.Now()
-			s.conn.SetReadDeadline(t.Add(readTimeout))
-			n, addr, err := s.conn.ReadFromUDP(buf)
-			if err == nil {
-				go s.route(buf[:n], addr)
-			} else {
-				s.handleErr(err, addr)
+		case <-ctx.Done():
+			s.abort()
+		case <-stopped:
+		}
+	}()
+	err := s.serve()
+	close(stopped)
+	if s.isTransferServer && err == errs.ErrServerClosed {
+		s.reportAborted()
+	}
+	if !s.isTransferServer {
+		s.stopTransfers()
+	}
+	s.release()
+	if err == errs.ErrServerClosed && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// serve handles packets until the server stops
+func (s *Server) serve() error {
+	for {
+		if s.aborted() {
+			return errs.ErrServerClosed
+		}
+		buf := make([]byte, s.readSize())
+		n, addr, dst, err := s.read(buf)
+		if err != nil {
+			if s.aborted() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return errs.ErrServerClosed
+			}
+			if s.handleErr(err, addr) {
+				return nil
+			}
+			continue
+		}
+		if s.isTransferServer {
+			// A transfer is a conversation with a single client,
+			// so its packets are handled in order.
+			if s.route(buf[:n], addr, dst) {
+				return nil
 			}
+		} else if t := s.transfer(addr); t != nil {
+			t.deliver(buf[:n], addr)
+		} else {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.routeRequest(buf[:n], addr, dst)
+			}()
 		}
 	}
 }
 
-func (s *Server) removeConnInfo() {
-	s.fileManager.DelConnInfo(s.conn.LocalAddr().(*net.UDPAddr).Port)
+// ServeTransfer serves transfer server t on behalf of the main server, which
+// waits for it to stop before its own Serve returns
+func (s *Server) ServeTransfer(t *Server) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t.Serve(context.Background())
+	}()
 }
 
-func (s *Server) handleErr(err error, addr *net.UDPAddr) {
-	// Server timeouts are OK (they give us a chance to check the
-	// StopCh).  Transfer timeouts cause the transfer server to finish.
-	if err.(net.Error).Timeout() {
+// read reads the next packet into buf, waiting until the read deadline.  The
+// packet's destination address is returned too, if it is known.
+func (s *Server) read(buf []byte) (int, *net.UDPAddr, net.IP, error) {
+	if s.packets != nil {
+		n, addr, err := s.readShared(buf)
+		return n, addr, nil, err
+	}
+	s.conn.SetReadDeadline(s.readDeadline())
+	if s.aborted() {
+		return 0, nil, nil, timeoutError{}
+	}
+	if !s.pktInfo {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		return n, addr, nil, err
+	}
+	oob := make([]byte, pktInfoOobSize)
+	n, oobn, _, addr, err := s.conn.ReadMsgUDP(buf, oob)
+	return n, addr, parsePktInfo(oob[:oobn]), err
+}
+
+// routeRequest routes a packet to the main server, keeping its destination
+// address for the handler (see LocalIP) until it is handled
+func (s *Server) routeRequest(buf []byte, src *net.UDPAddr, dst net.IP) {
+	if dst == nil {
+		s.route(buf, src, nil)
+		return
+	}
+	key := src.String()
+	s.transfersMu.Lock()
+	s.localIPs[key] = dst
+	s.transfersMu.Unlock()
+	defer func() {
+		s.transfersMu.Lock()
+		delete(s.localIPs, key)
+		s.transfersMu.Unlock()
+	}()
+	s.route(buf, src, dst)
+}
+
+// readSize returns the size of the largest packet the server can receive
+func (s *Server) readSize() int {
+	// The main server reads the packets of every transfer in single port
+	// mode
+	if !s.isTransferServer && s.config.SinglePort {
+		return s.config.MaxBlockSize + defs.DataHeaderSize
+	}
+	return s.blockSize + defs.DataHeaderSize
+}
+
+// Close stops the server right away.  A running Serve wakes up, aborts any
+// transfers, and returns without waiting for them to finish (see Shutdown for
+// that).  Serve releases the server's resources as it returns, so Close
+// releases them itself only for a server that isn't served.
+func (s *Server) Close() {
+	s.abort()
+	s.transfersMu.Lock()
+	served := s.serving
+	s.transfersMu.Unlock()
+	if served == nil {
+		s.release()
+	}
+}
+
+// release closes the server's connection, or for a transfer server sharing
+// the main server's connection, stops passing it packets.  A transfer server
+// also removes its conn info and unregisters from the main server.
+func (s *Server) release() {
+	s.releaseOnce.Do(func() {
+		if s.parent != nil {
+			s.parent.removeTransfer(s)
+		} else {
+			s.conn.Close()
+		}
 		if s.isTransferServer {
 			s.removeConnInfo()
-			s.StopCh <- struct{}{}
 		}
-		return
+		if s.owner != nil {
+			s.owner.removeActive(s)
+		}
+	})
+}
+
+func (s *Server) removeConnInfo() {
+	s.fileManager.DelConnInfo(s.Tid())
+}
+
+// readDeadline returns when to stop waiting for the next packet.  The main
+// server waits for as long as it takes.  Packets that don't move a transfer
+// along (e.g., duplicates) don't extend a transfer server's deadline, so they
+// can't hold off a retransmission.
+func (s *Server) readDeadline() time.Time {
+	if !s.isTransferServer {
+		return time.Time{}
+	}
+	if s.deadline.IsZero() {
+		return time.Now().Add(s.timeout)
+	}
+	return s.deadline
+}
+
+// maxBackoff caps the timeout as backoff doubles it, which would otherwise
+// overflow after enough retries
+const maxBackoff = defs.MaxTimeout * time.Second
+
+// resetDeadline starts the wait for the client over
+func (s *Server) resetDeadline() {
+	timeout := s.timeout
+	if s.config.Backoff {
+		limit := max(s.timeout, maxBackoff)
+		for i := 0; i < s.retries && timeout < limit; i++ {
+			timeout *= 2
+		}
+		timeout = min(timeout, limit)
+	}
+	s.deadline = time.Now().Add(timeout)
+}
+
+// handleErr handles an error reading from the connection and returns whether
+// the server should stop.
+func (s *Server) handleErr(err error, addr *net.UDPAddr) bool {
+	// Transfer timeouts cause the transfer server to retransmit, and
+	// eventually to give up.
+	if err.(net.Error).Timeout() {
+		return s.isTransferServer && !s.retransmit()
 	}
 	msg := "Error reading from UDP: " + err.Error()
 	log.Println(msg)
 	if s.isTransferServer {
-		s.removeConnInfo()
-		s.respondWithErr(errors.New(msg), addr)
-		s.StopCh <- struct{}{}
+		s.respondWithErr(errors.New(msg), addr, nil)
 	}
+	return s.isTransferServer
 }
 
-func (s *Server) route(buf []byte, src *net.UDPAddr) {
+// route handles a packet sent to dst (nil if it's unknown) and returns whether
+// the server should stop.  Replies are sent from dst (see write).
+func (s *Server) route(buf []byte, src *net.UDPAddr, dst net.IP) bool {
 	op, err := readOpCode(buf)
-	if err != nil || op < defs.MinOpCode || op > defs.MaxOpCode {
-		s.respondWithErr(&errs.SrvError{defs.ErrIllegalOp, err.Error()}, src)
-		return
+	if err == nil && (op < defs.MinOpCode || op > defs.MaxOpCode) {
+		err = errors.New(fmt.Sprintf("Illegal op: %d", op))
+	}
+	if err != nil {
+		return s.respondWithErr(
+			&errs.SrvError{Code: defs.ErrIllegalOp, Msg: err.Error()}, src, dst)
 	}
 	fn, ok := s.opToHandle[op]
 	if !ok {
 		msg := fmt.Sprintf("Unsupported op: %d", op)
 		log.Println(msg)
-		s.respondWithErr(errors.New(msg), src)
-		return
+		return s.respondWithErr(errors.New(msg), src, dst)
 	}
-	resp, err := fn(buf[defs.OpCodeSize:], s.conn, src, s.fileManager)
-	if err != nil {
+	resps, err := fn(buf[defs.OpCodeSize:], s, src)
+	if err == errs.ErrPacketIgnored {
+		return false
+	}
+	// A transfer is done once the handler says so (e.g., we just received
+	// a terminal ACK from the client), but there may still be a final
+	// response to send.
+	done := err == errs.ErrTransferDone
+	if err != nil && !done {
 		log.Println("Handle error: " + err.Error())
-		s.respondWithErr(err, src)
-		return
+		return s.respondWithErr(err, src, dst)
 	}
-	// No response if nil
-	if resp == nil {
-		// A transfer server returning nil means we're done (e.g.,
-		// we just received a terminal ACK from client)
-		if s.isTransferServer {
-			s.StopCh <- struct{}{}
+	err = s.respondFrom(resps, src, dst)
+	if err != nil {
+		log.Println(err)
+		return s.respondWithErr(err, src, dst)
+	}
+	return done && s.isTransferServer
+}
+
+// retransmit resends the last packets sent by a transfer server and returns
+// whether it did.  Once the retries are used up, the client is sent an ERROR
+// packet instead.
+func (s *Server) retransmit() bool {
+	if s.lastResps == nil {
+		return false
+	}
+	if s.retries >= s.config.Retries {
+		msg := fmt.Sprintf("Transfer timed out after %d retries", s.retries)
+		log.Println(msg)
+		s.respondWithErr(errors.New(msg), s.lastDst, nil)
+		return false
+	}
+	s.retries++
+	log.Printf("Transfer timed out, retransmitting (retry %d of %d)",
+		s.retries, s.config.Retries)
+	for _, resp := range s.lastResps {
+		if s.respond(resp, s.lastDst, nil) != nil {
+			return false
 		}
-	} else {
-		err = s.respond(resp, src)
+	}
+	s.resetDeadline()
+	return true
+}
+
+// Respond sends resps to dst, which may be none at all when a transfer is
+// in the middle of a window.  A transfer server keeps them so that they can
+// be retransmitted if the client doesn't make progress in time.
+func (s *Server) Respond(resps [][]byte, dst *net.UDPAddr) error {
+	return s.respondFrom(resps, dst, nil)
+}
+
+// respondFrom is Respond, sending from localIP (see write)
+func (s *Server) respondFrom(resps [][]byte, dst *net.UDPAddr, localIP net.IP) error {
+	for _, resp := range resps {
+		err := s.respond(resp, dst, localIP)
 		if err != nil {
-			log.Println(err)
-			s.respondWithErr(err, src)
-			return
+			return err
 		}
 	}
-	// We're done if we get an undersized data packet
-	if (op == defs.OpData && len(buf) < defs.DatagramSize) && s.isTransferServer {
-		s.StopCh <- struct{}{}
+	if s.isTransferServer {
+		if len(resps) > 0 {
+			s.lastResps, s.lastDst = resps, dst
+		}
+		s.retries = 0
+		s.resetDeadline()
 	}
+	return nil
 }
 
-func (s *Server) respond(resp []byte, src *net.UDPAddr) error {
-	n, err := s.conn.WriteToUDP(resp, src)
+func (s *Server) respond(resp []byte, src *net.UDPAddr, localIP net.IP) error {
+	n, err := s.write(resp, src, localIP)
 	if err != nil || n != len(resp) {
 		var msg string
 		if err != nil {
@@ -138,7 +542,9 @@ func (s *Server) respond(resp []byte, src *net.UDPAddr) error {
 	return err
 }
 
-func (s *Server) respondWithErr(err error, src *net.UDPAddr) {
+// respondWithErr sends an ERROR packet for err to src from localIP (see write)
+// and returns whether the error should stop the server.
+func (s *Server) respondWithErr(err error, src *net.UDPAddr, localIP net.IP) bool {
 	var srvErr *errs.SrvError
 	shouldStop := s.isTransferServer
 	switch err := err.(type) {
@@ -147,9 +553,9 @@ func (s *Server) respondWithErr(err error, src *net.UDPAddr) {
 	case errs.UnexpectedRemoteTidErr:
 		// Don't stop in the UnexpectedRemoteTidErr case
 		shouldStop = false
-		srvErr = &errs.SrvError{defs.ErrUnknownTid, err.Error()}
+		srvErr = &errs.SrvError{Code: defs.ErrUnknownTid, Msg: err.Error()}
 	default:
-		srvErr = &errs.SrvError{defs.ErrGeneric, err.Error()}
+		srvErr = &errs.SrvError{Code: defs.ErrGeneric, Msg: err.Error()}
 
 	}
 	rawMsg := []byte(srvErr.Msg)
@@ -162,16 +568,29 @@ func (s *Server) respondWithErr(err error, src *net.UDPAddr) {
 	if err != nil {
 		log.Printf("err building response: %s\n", err)
 	}
-	n, err := s.conn.WriteToUDP(resp, src)
+	n, err := s.write(resp, src, localIP)
 	if n != len(resp) {
 		log.Printf("Problem writing to UDP connection, %d of %d bytes written", n, len(resp))
 	}
 	if err != nil {
 		log.Println("Error writing to UDP connection: " + err.Error())
 	}
-	if shouldStop {
-		s.StopCh <- struct{}{}
+	return shouldStop
+}
+
+// write sends a packet to dst from localIP, or if that's nil, from the
+// server's local IP.  Without either, the kernel picks the source address.
+// The main server answers a request from the address it was sent to, which
+// it only knows per request.
+func (s *Server) write(buf []byte, dst *net.UDPAddr, localIP net.IP) (int, error) {
+	if localIP == nil {
+		localIP = s.localIP
+	}
+	if localIP == nil {
+		return s.conn.WriteToUDP(buf, dst)
 	}
+	n, _, err := s.conn.WriteMsgUDP(buf, buildPktInfo(localIP), dst)
+	return n, err
 }
 
 func readOpCode(buf []byte) (op uint16, err error) {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net"
 	"testing"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/bgmerrell/tftpdmem/defs"
 	fmgr "github.com/bgmerrell/tftpdmem/filemanager"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
 )
 
 // A testServer is a Server that includes a remote server UDPConn so that it
@@ -22,7 +24,7 @@ func (ts *testServer) Close() {
 	ts.rConn.Close()
 }
 
-func getTestServer(opToHandle OpToHandleMap) (*testServer, error) {
+func getTestServer(opToHandle OpToHandleMap, cfg *Config) (*testServer, error) {
 	lAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
 	lConn, err := net.ListenUDP(lAddr.Network(), lAddr)
 	if err != nil {
@@ -40,19 +42,23 @@ func getTestServer(opToHandle OpToHandleMap) (*testServer, error) {
 	rAddr = rConn.LocalAddr().(*net.UDPAddr)
 
 	return &testServer{
-		Server: New(lAddr.Port, lConn, opToHandle, false, fmgr.New()),
+		Server: New(lAddr.Port, lConn, opToHandle, false, fmgr.New(), cfg),
 		rConn:  rConn}, err
 }
 
 func TestServe(t *testing.T) {
 	opToHandle := OpToHandleMap{
-		defs.OpWrq: func([]byte, *net.UDPConn, *net.UDPAddr, *fmgr.FileManager) ([]byte, error) { return []byte("wrq"), nil }}
-	readTimeout = 100 * time.Millisecond
-	s, err := getTestServer(opToHandle)
+		defs.OpWrq: func([]byte, *Server, *net.UDPAddr) ([][]byte, error) { return [][]byte{[]byte("wrq")}, nil }}
+	cfg := DefaultConfig()
+	cfg.Timeout = 100 * time.Millisecond
+	s, err := getTestServer(opToHandle, cfg)
 	if err != nil {
 		t.Fatal("Failed to get test server:", err)
 	}
-	go s.Serve()
+	defer s.rConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- s.Serve(ctx) }()
 	rrqData := []byte{0x00, 0x01}
 	n, err := s.rConn.WriteToUDP(rrqData, s.conn.LocalAddr().(*net.UDPAddr))
 	if err != nil {
@@ -62,5 +68,223 @@ func TestServe(t *testing.T) {
 		t.Errorf("Read %d bytes, want: %d", n, len(rrqData))
 	}
 	time.Sleep(200 * time.Millisecond)
-	s.StopCh <- struct{}{}
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("err: %v, want: %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to return once its context was done")
+	}
+}
+
+func TestServeClose(t *testing.T) {
+	// The main server doesn't wake up for its timeout
+	s, err := getTestServer(OpToHandleMap{}, DefaultConfig())
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.rConn.Close()
+	errCh := make(chan error)
+	go func() { errCh <- s.Serve(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	s.Server.Close()
+	select {
+	case err := <-errCh:
+		if err != errs.ErrServerClosed {
+			t.Errorf("err: %v, want: %v", err, errs.ErrServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to return once the server was closed")
+	}
+}
+
+func TestServeTransferTimeout(t *testing.T) {
+	s, err := getTestServer(OpToHandleMap{}, DefaultConfig())
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.rConn.Close()
+	s.isTransferServer = true
+	s.SetTimeout(100 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		s.Serve(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected transfer server to stop after its timeout")
+	}
+}
+
+func TestServeTransferRetransmit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Retries = 2
+	s, err := getTestServer(OpToHandleMap{}, cfg)
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.rConn.Close()
+	s.isTransferServer = true
+	s.SetTimeout(50 * time.Millisecond)
+	pkt := []byte("data")
+	err = s.Respond([][]byte{pkt}, s.rConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	s.rConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, defs.DatagramSize)
+	// The original packet and two retransmissions...
+	for i := 0; i < 3; i++ {
+		n, _, err := s.rConn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != string(pkt) {
+			t.Errorf("packet %d: %q, want: %q", i, buf[:n], pkt)
+		}
+	}
+	// ...followed by an ERROR
+	n, _, err := s.rConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < defs.OpCodeSize || buf[1] != defs.OpErr {
+		t.Errorf("Got packet: %#v, want ERROR", buf[:n])
+	}
+}
+
+func TestResetDeadlineBackoff(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Backoff = true
+	s, err := getTestServer(OpToHandleMap{}, cfg)
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.Close()
+	for retries, want := range map[int]time.Duration{
+		0:  10 * time.Second,
+		2:  40 * time.Second,
+		5:  maxBackoff,
+		40: maxBackoff,
+		64: maxBackoff} {
+		s.retries = retries
+		start := time.Now()
+		s.resetDeadline()
+		if got := s.deadline.Sub(start); got < want || got > want+time.Second {
+			t.Errorf("retries: %d: timeout: %s, want: %s", retries, got, want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, err := getTestServer(OpToHandleMap{}, DefaultConfig())
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.Close()
+	tConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid := tConn.LocalAddr().(*net.UDPAddr).Port
+	transfer := New(tid, tConn, OpToHandleMap{}, true, s.fileManager, s.config)
+	err = s.AddTransfer(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transfer.Respond([][]byte{[]byte("data")}, s.rConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ServeTransfer(transfer)
+
+	// The transfer outlasts the grace period, so it's aborted
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	interrupted, err := s.Shutdown(ctx)
+	if len(interrupted) != 1 || err != context.DeadlineExceeded {
+		t.Errorf("Interrupted: %v (%v), want one transfer", interrupted, err)
+	}
+	// Shutdown waits for the transfer server to stop and close its conn
+	if !transfer.aborted() || transfer.conn.SetReadDeadline(time.Time{}) == nil {
+		t.Fatal("Expected transfer server to be stopped")
+	}
+	s.rConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, defs.DatagramSize)
+	for _, want := range []string{"data", "\x00\x05\x00\x00Server is shutting down\x00"} {
+		n, _, err := s.rConn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("Got packet: %q, want: %q", buf[:n], want)
+		}
+	}
+
+	// No new transfers start
+	if err := s.AddTransfer(New(0, nil, nil, true, s.fileManager, s.config)); err != errs.ErrShuttingDown {
+		t.Errorf("err: %v, want: %v", err, errs.ErrShuttingDown)
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	s, err := getTestServer(OpToHandleMap{}, DefaultConfig())
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.Close()
+	tConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := New(1, tConn, OpToHandleMap{}, true, s.fileManager, s.config)
+	err = s.AddTransfer(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The transfer finishes during the grace period
+	time.AfterFunc(50*time.Millisecond, transfer.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	interrupted, err := s.Shutdown(ctx)
+	if interrupted != nil || err != nil {
+		t.Errorf("Interrupted: %v (%v), want none", interrupted, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected Shutdown to return once the transfer finished")
+	}
+}
+
+func TestNewSharedTransferServerDuplicate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SinglePort = true
+	s, err := getTestServer(OpToHandleMap{}, cfg)
+	if err != nil {
+		t.Fatal("Failed to get test server:", err)
+	}
+	defer s.Close()
+	peer := s.rConn.LocalAddr().(*net.UDPAddr)
+	first, err := s.NewSharedTransferServer(OpToHandleMap{}, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A retransmitted request doesn't replace the first transfer...
+	_, err = s.NewSharedTransferServer(OpToHandleMap{}, peer)
+	if err != errs.ErrPacketIgnored {
+		t.Errorf("err: %v, want: %v", err, errs.ErrPacketIgnored)
+	}
+	if got := s.transfer(peer); got != first {
+		t.Errorf("transfer: %p, want: %p", got, first)
+	}
+	// ...but the client can start another once it's done
+	first.Close()
+	if _, err := s.NewSharedTransferServer(OpToHandleMap{}, peer); err != nil {
+		t.Error(err)
+	}
 }
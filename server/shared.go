@@ -0,0 +1,97 @@
+package server
+
+import (
+	"log"
+	"net"
+	"time"
+
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
+)
+
+// packetQueueLen is how many packets the main server queues for a transfer
+// server that shares its port.  Later packets are dropped, just as the
+// kernel would drop them from a full socket buffer.
+const packetQueueLen = 64
+
+// A packet is a packet passed from the main server to a transfer server that
+// shares its port
+type packet struct {
+	buf []byte
+	src *net.UDPAddr
+}
+
+// timeoutError is returned by reads from the packet queue that time out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// NewSharedTransferServer returns a new transfer server for the client at peer
+// that shares s's connection (see Config.SinglePort).  Until the transfer
+// server is closed, s passes it all of the packets from peer.  A client has
+// one such transfer at a time, so ErrPacketIgnored is returned if peer has
+// one already, e.g., for a retransmitted request that was read before the
+// first request's transfer started.
+func (s *Server) NewSharedTransferServer(opToHandle OpToHandleMap, peer *net.UDPAddr) (*Server, error) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	if s.transfers[peer.String()] != nil {
+		return nil, errs.ErrPacketIgnored
+	}
+	// The TID comes from the file manager, which other main servers may
+	// share
+	t := New(s.fileManager.NewTid(), s.conn, opToHandle, true,
+		s.fileManager, s.config)
+	t.packets = make(chan packet, packetQueueLen)
+	t.parent = s
+	t.peer = peer
+	// Replies go out of the shared connection, so they need to name the
+	// address the client sent its request to
+	if s.pktInfo {
+		t.localIP = s.localIPs[peer.String()]
+	}
+	s.transfers[peer.String()] = t
+	return t, nil
+}
+
+// transfer returns the transfer server for the client at addr, or nil if
+// there is none
+func (s *Server) transfer(addr *net.UDPAddr) *Server {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	return s.transfers[addr.String()]
+}
+
+// removeTransfer stops passing packets to transfer server t
+func (s *Server) removeTransfer(t *Server) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	if s.transfers[t.peer.String()] == t {
+		delete(s.transfers, t.peer.String())
+	}
+}
+
+// deliver queues a packet for a transfer server, dropping it if the queue is
+// full
+func (s *Server) deliver(buf []byte, src *net.UDPAddr) {
+	select {
+	case s.packets <- packet{buf, src}:
+	default:
+		log.Printf("Dropping packet from %s, transfer queue is full", src)
+	}
+}
+
+// readShared reads the next packet from the packet queue into buf
+func (s *Server) readShared(buf []byte) (int, *net.UDPAddr, error) {
+	timer := time.NewTimer(s.readDeadline().Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case p := <-s.packets:
+		return copy(buf, p.buf), p.src, nil
+	case <-timer.C:
+		return 0, nil, timeoutError{}
+	case <-s.abortCh:
+		return 0, nil, timeoutError{}
+	}
+}
@@ -1,56 +1,193 @@
-package main
+// Package tftpdmem runs a TFTP server that stores its files in memory (or in
+// any other fmgr.Store).  It can be embedded in a program, e.g., to give
+// integration tests a TFTP server whose files they can seed and inspect
+// directly.
+package tftpdmem
 
 import (
-	"fmt"
-	"flag"
-	"log"
+	"context"
+	"errors"
 	"net"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 
 	"github.com/bgmerrell/tftpdmem/defs"
 	fmgr "github.com/bgmerrell/tftpdmem/filemanager"
 	"github.com/bgmerrell/tftpdmem/handlers"
 	"github.com/bgmerrell/tftpdmem/server"
+	errs "github.com/bgmerrell/tftpdmem/server/errors"
 )
 
-// flags
-var (
-	port int
-)
+// ErrServerClosed is returned by Serve and ListenAndServe once the server is
+// closed.
+var ErrServerClosed = errs.ErrServerClosed
+
+// Options configures a Server.  The zero value serves on the standard TFTP
+// port with the default settings.
+type Options struct {
+	// Addr is the address that ListenAndServe listens on, as host:port.
+	// The default is ":69", which is dual-stack.
+	Addr string
+	// Config holds the transfer settings (nil means
+	// server.DefaultConfig()), which New validates (see
+	// server.Config.Validate).
+	Config *server.Config
+	// Capacity is the most bytes of file data to store (zero means no
+	// limit).
+	Capacity int
+	// Overwrite decides what happens when a client writes an existing
+	// file, and PrefixOverwrite overrides it for filenames with a prefix.
+	Overwrite       fmgr.OverwritePolicy
+	PrefixOverwrite map[string]fmgr.OverwritePolicy
+	// WriteConflict decides what happens when a client writes a file that
+	// another client is writing.
+	WriteConflict fmgr.WriteConflictPolicy
+	// Store holds the files (nil means a new fmgr.MemStore).  Files already
+	// in the store count against the capacity.
+	Store fmgr.Store
+}
 
-func init() {
-	flag.IntVar(&port, "port", 69, "Port for the tftp server")
-	flag.Parse()
+// A Server is a TFTP server.  It may serve any number of connections, which
+// share its files.
+type Server struct {
+	addr    string
+	config  *server.Config
+	fm      *fmgr.FileManager
+	mu      sync.Mutex
+	servers []*server.Server
+	closed  bool
 }
 
-func main() {
-	laddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+// New returns a new Server configured by opts
+func New(opts Options) (*Server, error) {
+	if opts.Config != nil {
+		if err := opts.Config.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	store := opts.Store
+	if store == nil {
+		store = fmgr.NewMemStore()
+	}
+	fm, err := fmgr.NewWithStore(store)
 	if err != nil {
-		log.Println("Failed to resolve UDP addr:", err)
-		os.Exit(1)
+		return nil, err
+	}
+	s := &Server{addr: opts.Addr, config: opts.Config, fm: fm}
+	if s.addr == "" {
+		s.addr = ":69"
+	}
+	if s.config == nil {
+		s.config = server.DefaultConfig()
+	}
+	s.fm.SetCapacity(opts.Capacity)
+	s.fm.SetOverwritePolicy(opts.Overwrite)
+	s.fm.SetWriteConflictPolicy(opts.WriteConflict)
+	for prefix, policy := range opts.PrefixOverwrite {
+		s.fm.SetPrefixOverwritePolicy(prefix, policy)
+	}
+	return s, nil
+}
+
+// Files returns the server's file manager, which can be used to seed files
+// and to check on the files that clients have written.
+func (s *Server) Files() *fmgr.FileManager {
+	return s.fm
+}
+
+// ListenAndServe listens on the UDP address in the options and serves TFTP
+// requests until the server is closed.
+func (s *Server) ListenAndServe() error {
+	laddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return err
 	}
-	log.Println("Starting tftpdmem on port", port)
 	conn, err := net.ListenUDP(laddr.Network(), laddr)
 	if err != nil {
-		log.Println("ListenUDP failure:", err)
-		os.Exit(1)
+		return err
 	}
-	defer conn.Close()
+	return s.Serve(conn)
+}
 
-	// The "main" server only supports ACK and read and write requests,
+// Serve serves TFTP requests from conn until the server is closed, and then
+// closes conn.  Only UDP conns are supported.
+func (s *Server) Serve(conn net.PacketConn) error {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return errors.New("Serve needs a *net.UDPConn")
+	}
+	// The main server only supports ACK and read and write requests,
 	// which create new servers for data transfer.
 	opToHandle := server.OpToHandleMap{
 		defs.OpWrq: handlers.HandleWriteRequest,
 		defs.OpRrq: handlers.HandleReadRequest,
-		// We'll just ignore ACKs to the main server, this server isn't
-		// smart enough to do anything about them.
-		defs.OpAck: func([]byte, *net.UDPConn, *net.UDPAddr, *fmgr.FileManager) ([]byte, error) { return nil, nil }}
-	s := server.New(port, conn, opToHandle, false, fmgr.New())
-	go s.Serve()
-
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
-	log.Println(<-sigCh)
+		// ACKs to the main server are ignored
+		defs.OpAck: func([]byte, *server.Server, *net.UDPAddr) ([][]byte, error) { return nil, nil }}
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	srv := server.New(port, udpConn, opToHandle, false, s.fm, s.config)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		srv.Close()
+		return ErrServerClosed
+	}
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+	return srv.Serve(context.Background())
+}
+
+// Addr returns the address of the first conn the server is serving, or nil
+// if there is none yet
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.servers) == 0 {
+		return nil
+	}
+	return s.servers[0].Conn().LocalAddr()
+}
+
+// Close stops the server right away, aborting any transfers in progress
+func (s *Server) Close() error {
+	for _, srv := range s.stop() {
+		srv.Close()
+	}
+	return nil
+}
+
+// Shutdown stops the server from starting new transfers and waits until the
+// transfers in progress end or ctx is done, at which point the rest are
+// aborted.  It returns once the server has stopped, with a description of
+// each aborted transfer and, if there were any, ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) ([]string, error) {
+	var (
+		interrupted []string
+		err         error
+		mu          sync.Mutex
+		wg          sync.WaitGroup
+	)
+	for _, srv := range s.stop() {
+		wg.Add(1)
+		go func(srv *server.Server) {
+			defer wg.Done()
+			descs, srvErr := srv.Shutdown(ctx)
+			mu.Lock()
+			interrupted = append(interrupted, descs...)
+			if srvErr != nil {
+				err = srvErr
+			}
+			mu.Unlock()
+		}(srv)
+	}
+	wg.Wait()
+	return interrupted, err
+}
+
+// stop marks the server closed, so that Serve won't start, and returns the
+// servers it has started
+func (s *Server) stop() []*server.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.servers
 }
@@ -0,0 +1,184 @@
+package tftpdmem
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/tftpdmem/defs"
+	"github.com/bgmerrell/tftpdmem/server"
+)
+
+// exchange sends a packet to addr and returns the response and its source
+func exchange(t *testing.T, c *net.UDPConn, addr *net.UDPAddr, send string) (string, *net.UDPAddr) {
+	_, err := c.WriteToUDP([]byte(send), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, defs.DatagramSize)
+	n, src, err := c.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), src
+}
+
+func TestServer(t *testing.T) {
+	s, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Files().AddFile("foo", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error)
+	go func() { errCh <- s.Serve(conn) }()
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	addr := s.Addr().(*net.UDPAddr)
+	if addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Addr: %s, want: %s", addr, conn.LocalAddr())
+	}
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Read the seeded file
+	resp, src := exchange(t, c, addr, "\x00\x01foo\x00octet\x00")
+	if resp != "\x00\x03\x00\x01abc" {
+		t.Errorf("Data: %q, want: %q", resp, "\x00\x03\x00\x01abc")
+	}
+	c.WriteToUDP([]byte("\x00\x04\x00\x01"), src)
+	// And write another
+	_, src = exchange(t, c, addr, "\x00\x02bar\x00octet\x00")
+	resp, _ = exchange(t, c, src, "\x00\x03\x00\x01xyz")
+	if resp != "\x00\x04\x00\x01" {
+		t.Errorf("Ack: %q, want: %q", resp, "\x00\x04\x00\x01")
+	}
+	data, err := s.Files().File("bar")
+	if err != nil || string(data) != "xyz" {
+		t.Errorf("data: %q (%v), want: %q", data, err, "xyz")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	interrupted, err := s.Shutdown(ctx)
+	if interrupted != nil || err != nil {
+		t.Errorf("Interrupted: %v (%v), want none", interrupted, err)
+	}
+	if err := <-errCh; err != ErrServerClosed {
+		t.Errorf("err: %v, want: %v", err, ErrServerClosed)
+	}
+	// A closed server doesn't serve again
+	conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(conn); err != ErrServerClosed {
+		t.Errorf("err: %v, want: %v", err, ErrServerClosed)
+	}
+}
+
+func TestServerListenAndServe(t *testing.T) {
+	s, err := New(Options{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error)
+	go func() { errCh <- s.ListenAndServe() }()
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+	select {
+	case err := <-errCh:
+		if err != ErrServerClosed {
+			t.Errorf("err: %v, want: %v", err, ErrServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected ListenAndServe to return once the server was closed")
+	}
+}
+
+func TestNewPortRange(t *testing.T) {
+	for _, ports := range [][2]int{{50000, 0}, {0, 50000}, {50001, 50000}, {65535, 65536}} {
+		cfg := server.DefaultConfig()
+		cfg.MinPort, cfg.MaxPort = ports[0], ports[1]
+		if _, err := New(Options{Config: cfg}); err == nil {
+			t.Errorf("%d-%d: Expected error for invalid port range", ports[0], ports[1])
+		}
+	}
+	cfg := server.DefaultConfig()
+	cfg.MinPort, cfg.MaxPort = 50000, 50000
+	if _, err := New(Options{Config: cfg}); err != nil {
+		t.Errorf("50000-50000: %v", err)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	// A Config not started from DefaultConfig is missing settings
+	if _, err := New(Options{Config: &server.Config{SinglePort: true}}); err == nil {
+		t.Error("Expected error for a Config with zero settings")
+	}
+	for i, set := range []func(*server.Config){
+		func(cfg *server.Config) { cfg.MaxBlockSize = defs.MinBlockSize - 1 },
+		func(cfg *server.Config) { cfg.MaxBlockSize = defs.MaxBlockSize + 1 },
+		func(cfg *server.Config) { cfg.MaxWindowSize = 0 },
+		func(cfg *server.Config) { cfg.MaxWindowSize = defs.MaxWindowSize + 1 },
+		func(cfg *server.Config) { cfg.Rollover = 2 },
+		func(cfg *server.Config) { cfg.Timeout = 0 },
+		func(cfg *server.Config) { cfg.Retries = -1 },
+	} {
+		cfg := server.DefaultConfig()
+		set(cfg)
+		if _, err := New(Options{Config: cfg}); err == nil {
+			t.Errorf("%d: Expected error for invalid config %+v", i, cfg)
+		}
+	}
+	if _, err := New(Options{Config: server.DefaultConfig()}); err != nil {
+		t.Errorf("Default config: %v", err)
+	}
+}
+
+func TestServerSinglePortListeners(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.SinglePort = true
+	s, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Files().AddFile("foo", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Start a transfer on each listener, leaving the first one open while
+	// the second starts
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(conn)
+		addr := conn.LocalAddr().(*net.UDPAddr)
+		resp, _ := exchange(t, c, addr, "\x00\x01foo\x00octet\x00")
+		if resp != "\x00\x03\x00\x01abc" {
+			t.Errorf("Listener %d: Data: %q, want: %q", i, resp, "\x00\x03\x00\x01abc")
+		}
+	}
+}